@@ -0,0 +1,275 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+// Backend is a user defined way to run tasks' scripts on the hosts.
+// It builds a command line like "docker exec" or "kubectl exec" for every host.
+type Backend struct {
+	Name        string
+	Description string
+	// Command returns the command line to run the script on the host.
+	Command  func(task *Task, host *Host, script string) ([]string, error)
+	Registry *Registry
+	LValues  map[string]lua.LValue
+	Parent   *Backend
+	Child    *Backend
+}
+
+var Backends map[string]*Backend
+
+// backendMutex guards the lua state from the backends that run in parallel.
+var backendMutex sync.Mutex
+
+func NewBackend() *Backend {
+	return &Backend{
+		LValues: map[string]lua.LValue{},
+	}
+}
+
+func (b *Backend) MapLValuesToLTable(tb *lua.LTable) {
+	for key, value := range b.LValues {
+		tb.RawSetString(key, value)
+	}
+}
+
+// IsBuiltinBackend returns true if the name is 'local' or 'remote'.
+func IsBuiltinBackend(name string) bool {
+	return name == TASK_BACKEND_LOCAL || name == TASK_BACKEND_REMOTE
+}
+
+func getBackend(name string) (*Backend, error) {
+	b := Backends[name]
+	if b == nil {
+		return nil, fmt.Errorf("backend '%s' is not defined.", name)
+	}
+
+	if b.Command == nil {
+		return nil, fmt.Errorf("invalid backend '%s'. The command was not defined.", name)
+	}
+
+	return b, nil
+}
+
+func runBackendTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+	backend, err := getBackend(task.Backend)
+	if err != nil {
+		return err
+	}
+
+	script, err := renderTaskScript(sshConfigPath, task, host)
+	if err != nil {
+		return err
+	}
+
+	args, err := backend.Command(task, host, script)
+	if err != nil {
+		return fmt.Errorf("backend '%s' failed to build the command: %v", backend.Name, err)
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("backend '%s' returned an empty command.", backend.Name)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = WorkingDir
+	if debugFlag {
+		fmt.Printf("[essh debug] real backend command: %v \n", redact(fmt.Sprint(cmd.Args)))
+	}
+
+	return runTaskCommand(cmd, task, host, hosts, stdinCh, m)
+}
+
+func esshBackend(L *lua.LState) int {
+	name := L.CheckString(1)
+	if L.GetTop() == 1 {
+		// object or DSL style
+		b := registerBackend(L, name)
+		L.Push(newLBackend(L, b))
+
+		return 1
+	} else if L.GetTop() == 2 {
+		b := registerBackend(L, name)
+		if fn, ok := toLFunction(L.CheckAny(2)); ok {
+			// function style with a command function.
+			updateBackend(L, b, "command", fn)
+		} else {
+			// function style
+			setupBackend(L, b, L.CheckTable(2))
+		}
+		L.Push(newLBackend(L, b))
+
+		return 1
+	}
+
+	panic("backend requires 1 or 2 arguments")
+}
+
+func registerBackend(L *lua.LState, name string) *Backend {
+	if debugFlag {
+		fmt.Printf("[essh debug] register backend: %s\n", name)
+	}
+
+	if IsBuiltinBackend(name) {
+		L.RaiseError("backend '%s' is a built-in backend.", name)
+	}
+
+	b := NewBackend()
+	b.Name = name
+	b.Registry = CurrentRegistry
+
+	if backend := Backends[b.Name]; backend != nil {
+		// detect same name backend
+		b.Child = backend
+		backend.Parent = b
+	}
+
+	Backends[b.Name] = b
+
+	return b
+}
+
+func setupBackend(L *lua.LState, b *Backend, config *lua.LTable) {
+	config.ForEach(func(k, v lua.LValue) {
+		if kstr, ok := toString(k); ok {
+			updateBackend(L, b, kstr, v)
+		}
+	})
+}
+
+func updateBackend(L *lua.LState, b *Backend, key string, value lua.LValue) {
+	b.LValues[key] = value
+
+	switch key {
+	case "description":
+		if descStr, ok := toString(value); ok {
+			b.Description = descStr
+		} else {
+			panic("invalid value of a backend's field '" + key + "'.")
+		}
+	case "command":
+		commandFn, ok := toLFunction(value)
+		if !ok {
+			L.RaiseError("backend 'command' have to be a function.")
+		}
+
+		b.Command = func(task *Task, host *Host, script string) ([]string, error) {
+			backendMutex.Lock()
+			defer backendMutex.Unlock()
+
+			ctx := L.NewTable()
+			ctx.RawSetString("task", newLTask(L, task))
+			if host != nil {
+				ctx.RawSetString("host", newLHost(L, host))
+			}
+			ctx.RawSetString("script", lua.LString(script))
+
+			err := L.CallByParam(lua.P{
+				Fn:      commandFn,
+				NRet:    1,
+				Protect: true,
+			}, ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			ret := L.Get(-1) // returned value
+			L.Pop(1)
+
+			tb, ok := toLTable(ret)
+			if !ok {
+				return nil, fmt.Errorf("backend command has to return a table.")
+			}
+
+			args := []string{}
+			maxn := tb.MaxN()
+			for i := 1; i <= maxn; i++ {
+				arg, ok := toString(tb.RawGetInt(i))
+				if !ok {
+					// allow numbers like a port.
+					f, isNum := toFloat64(tb.RawGetInt(i))
+					if !isNum {
+						return nil, fmt.Errorf("backend command has to return a table of strings.")
+					}
+					arg = strconv.FormatFloat(f, 'f', -1, 64)
+				}
+				args = append(args, arg)
+			}
+
+			return args, nil
+		}
+	default:
+		panic("unsupported backend's field '" + key + "'.")
+	}
+}
+
+const LBackendClass = "Backend*"
+
+func registerBackendClass(L *lua.LState) {
+	mt := L.NewTypeMetatable(LBackendClass)
+	mt.RawSetString("__call", L.NewFunction(backendCall))
+	mt.RawSetString("__index", L.NewFunction(backendIndex))
+	mt.RawSetString("__newindex", L.NewFunction(backendNewindex))
+}
+
+func newLBackend(L *lua.LState, backend *Backend) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = backend
+	L.SetMetatable(ud, L.GetTypeMetatable(LBackendClass))
+	return ud
+}
+
+func checkBackend(L *lua.LState) *Backend {
+	ud := L.CheckUserData(1)
+	if v, ok := ud.Value.(*Backend); ok {
+		return v
+	}
+	L.ArgError(1, "Backend object expected")
+	return nil
+}
+
+func backendCall(L *lua.LState) int {
+	backend := checkBackend(L)
+	tb := L.CheckTable(2)
+
+	setupBackend(L, backend, tb)
+
+	L.Push(L.CheckUserData(1))
+	return 1
+}
+
+func backendIndex(L *lua.LState) int {
+	backend := checkBackend(L)
+	index := L.CheckString(2)
+
+	if index == "name" {
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(backend.Name))
+			return 1
+		}))
+		return 1
+	}
+
+	v, ok := backend.LValues[index]
+	if v == nil || !ok {
+		v = lua.LNil
+	}
+
+	L.Push(v)
+	return 1
+}
+
+func backendNewindex(L *lua.LState) int {
+	backend := checkBackend(L)
+	index := L.CheckString(2)
+	value := L.CheckAny(3)
+
+	updateBackend(L, backend, index, value)
+
+	return 0
+}
@@ -0,0 +1,125 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ConfigDirName is a directory in the data directory that has config files split from the main config file.
+var ConfigDirName = "conf.d"
+
+// SkipMainConfigMarker is a file in the conf.d directory that disables the main config file.
+var SkipMainConfigMarker = ".skip-main-config"
+
+// configDir returns the conf.d directory of the data directory like "~/.essh".
+func configDir(dataDir string) string {
+	return filepath.Join(dataDir, ConfigDirName)
+}
+
+// hasConfigDir returns true if the data directory has the conf.d directory.
+func hasConfigDir(dataDir string) bool {
+	fi, err := os.Stat(configDir(dataDir))
+	return err == nil && fi.IsDir()
+}
+
+// configDirFiles returns the lua files in the conf.d directory in lexical order.
+func configDirFiles(dataDir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(configDir(dataDir), "*.lua"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// loadedConfigFiles is the config and inventory files that have been loaded. --rotate-secret-key rewrites them.
+var loadedConfigFiles = []string{}
+
+// loadConfigFile evaluates the config file and the modules that the file uses.
+func loadConfigFile(L *lua.LState, configFile string) error {
+	if debugFlag {
+		fmt.Printf("[essh debug] loading config file: %s\n", configFile)
+	}
+
+	loadedConfigFiles = append(loadedConfigFiles, configFile)
+
+	if err := L.DoFile(configFile); err != nil {
+		return err
+	}
+
+	if err := evaluateModules(); err != nil {
+		return err
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] loaded config file: %s\n", configFile)
+	}
+
+	return nil
+}
+
+// loadConfigLayer loads the inventory files, the main config file and then the files in the conf.d directory of the data directory.
+// The main config file is skipped if the conf.d directory has the SkipMainConfigMarker.
+// If a profile is active, the overlay config file of the profile is loaded at last.
+func loadConfigLayer(L *lua.LState, configFile string, dataDir string) error {
+	if err := loadInventory(L, dataDir); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(configDir(dataDir), SkipMainConfigMarker)); err == nil {
+		if debugFlag {
+			fmt.Printf("[essh debug] skipped config file by %s: %s\n", SkipMainConfigMarker, configFile)
+		}
+	} else if _, err := os.Stat(configFile); err == nil {
+		if err := loadConfigFile(L, configFile); err != nil {
+			return err
+		}
+	}
+
+	files, err := configDirFiles(dataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := loadConfigFile(L, file); err != nil {
+			return err
+		}
+	}
+
+	if profileVar != "" {
+		// a misspelled profile must not run the tasks with the base config.
+		profileFile := profileConfigFile(configFile, profileVar)
+		if _, err := os.Stat(profileFile); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("profile '%s' is not found. the overlay config file '%s' doesn't exist.", profileVar, profileFile)
+			}
+			return err
+		}
+
+		if err := loadConfigFile(L, profileFile); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasProjectConfig returns true if the working directory has the config file, the conf.d or inventory directory.
+func hasProjectConfig() bool {
+	if _, err := os.Stat(WorkingDirConfigFile); err == nil {
+		return true
+	}
+
+	return hasProjectDataDir(WorkingDataDir)
+}
+
+// hasProjectDataDir returns true if the data directory has the conf.d or inventory directory.
+// The user's data directory is not the project's one even if the working directory is the home directory.
+func hasProjectDataDir(dataDir string) bool {
+	return dataDir != UserDataDir && (hasConfigDir(dataDir) || hasInventoryDir(dataDir))
+}
@@ -0,0 +1,191 @@
+package essh
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/color"
+	"github.com/yuin/gopher-lua"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"strings"
+)
+
+// ConfirmSampleHostsNum is a number of host names that are displayed in the confirmation prompt.
+var ConfirmSampleHostsNum = 5
+
+// Confirmation is a prompt to confirm running a task.
+type Confirmation struct {
+	Messages []string
+	// Word is a word that must be typed to continue. If it is empty, the prompt asks yes or no.
+	Word string
+}
+
+func toConfirm(L *lua.LState, task *Task, value lua.LValue) {
+	if confirmBool, ok := toBool(value); ok {
+		task.Confirm = confirmBool
+	} else if confirmStr, ok := toString(value); ok {
+		task.Confirm = true
+		task.ConfirmMessage = confirmStr
+	} else if confirmTb, ok := toLTable(value); ok {
+		task.Confirm = true
+		confirmTb.ForEach(func(k, v lua.LValue) {
+			ks, _ := toString(k)
+			switch ks {
+			case "message":
+				if s, ok := toString(v); ok {
+					task.ConfirmMessage = s
+				} else {
+					L.RaiseError("confirm 'message' must be a string.")
+				}
+			case "typed":
+				if b, ok := toBool(v); ok {
+					task.ConfirmTyped = b
+				} else {
+					L.RaiseError("confirm 'typed' must be a boolean.")
+				}
+			default:
+				L.RaiseError("unsupported confirm's field '%v'.", k)
+			}
+		})
+	} else {
+		L.RaiseError("confirm must be a boolean, string or table.")
+	}
+}
+
+// newTaskConfirmation returns a confirmation that is required to run the task on the hosts.
+// It returns nil if the confirmation is not required.
+func newTaskConfirmation(L *lua.LState, task *Task, hosts []*Host, decisions []*PolicyDecision) (*Confirmation, error) {
+	c := &Confirmation{Messages: []string{}}
+	required := false
+
+	if messages := policyConfirmMessages(decisions); len(messages) > 0 {
+		required = true
+		c.Messages = append(c.Messages, messages...)
+	}
+
+	if task.Confirm {
+		required = true
+		if task.ConfirmMessage != "" {
+			c.Messages = append(c.Messages, task.ConfirmMessage)
+		}
+		if task.ConfirmTyped {
+			c.Word = task.Name
+		}
+	}
+
+	lessh, ok := toLTable(L.GetGlobal("essh"))
+	if !ok {
+		return nil, fmt.Errorf("essh must be a table")
+	}
+
+	if v := lessh.RawGetString("confirm_hosts_threshold"); v != lua.LNil {
+		threshold, ok := toFloat64(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v in the 'confirm_hosts_threshold'", v)
+		}
+
+		if len(hosts) > int(threshold) {
+			required = true
+			c.Messages = append(c.Messages, fmt.Sprintf("The number of hosts exceeds %d.", int(threshold)))
+		}
+	}
+
+	if v := lessh.RawGetString("protected_tags"); v != lua.LNil {
+		tags, ok := toSlice(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid value %v in the 'protected_tags'", v)
+		}
+
+	L1:
+		for _, tag := range tags {
+			tagStr, ok := tag.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid value %v in the 'protected_tags'", v)
+			}
+
+			for _, host := range hosts {
+				for _, t := range host.Tags {
+					if t == tagStr {
+						required = true
+						c.Messages = append(c.Messages, fmt.Sprintf("The hosts include protected '%s' hosts.", tagStr))
+						// needs to type the environment name.
+						c.Word = tagStr
+						break L1
+					}
+				}
+			}
+		}
+	}
+
+	if !required {
+		return nil, nil
+	}
+
+	return c, nil
+}
+
+func confirmTask(L *lua.LState, task *Task, hosts []*Host, decisions []*PolicyDecision) error {
+	c, err := newTaskConfirmation(L, task, hosts, decisions)
+	if err != nil {
+		return err
+	}
+
+	if c == nil {
+		return nil
+	}
+
+	if yesFlag {
+		if debugFlag {
+			fmt.Printf("[essh debug] skip confirmation by --yes option.\n")
+		}
+		return nil
+	}
+
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return fmt.Errorf("task '%s' requires confirmation, but stdin is not a terminal. use --yes option to run it without confirmation.", task.Name)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s\n", color.FgYB("You are about to run '%s' on %d hosts: %s", task.Name, len(hosts), sampleHostNames(hosts)))
+	for _, msg := range c.Messages {
+		fmt.Fprintf(os.Stderr, "%s\n", msg)
+	}
+
+	if c.Word != "" {
+		fmt.Fprintf(os.Stderr, "Type '%s' to continue: ", c.Word)
+	} else {
+		fmt.Fprintf(os.Stderr, "Continue? [y/N]: ")
+	}
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	answer = strings.TrimSpace(answer)
+
+	if c.Word != "" {
+		if answer != c.Word {
+			return fmt.Errorf("canceled. the typed text did not match '%s'.", c.Word)
+		}
+	} else if answer != "y" && answer != "yes" {
+		return fmt.Errorf("canceled.")
+	}
+
+	return nil
+}
+
+func sampleHostNames(hosts []*Host) string {
+	if len(hosts) == 0 {
+		return "(local)"
+	}
+
+	names := []string{}
+	for i, host := range hosts {
+		if i >= ConfirmSampleHostsNum {
+			names = append(names, fmt.Sprintf("... (%d more)", len(hosts)-ConfirmSampleHostsNum))
+			break
+		}
+		names = append(names, host.Name)
+	}
+
+	return strings.Join(names, ", ")
+}
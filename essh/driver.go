@@ -5,19 +5,30 @@ import (
 	"fmt"
 	"github.com/yuin/gopher-lua"
 	"runtime"
+	"sort"
 	"strings"
 	"text/template"
+	"text/template/parse"
 )
 
 type Driver struct {
-	Name     string
-	Props    map[string]interface{}
-	Engine   func(*Driver) (string, error)
-	Registry *Registry
-	Group    *Group
-	LValues  map[string]lua.LValue
-	Parent   *Driver
-	Child    *Driver
+	Name   string
+	Props  map[string]interface{}
+	Engine func(*Driver) (string, error)
+	// Extends is a name of the parent driver. The driver inherits the parent's template.
+	Extends string
+	// Blocks overrides the named template blocks like "pre", "script" and "post".
+	Blocks map[string]string
+	// Interpreter is a name of the interpreter that runs the generated script.
+	Interpreter string
+	Registry    *Registry
+	Group       *Group
+	Module      *Module
+	LValues     map[string]lua.LValue
+	Parent      *Driver
+	Child       *Driver
+	// Source is a position of the lua code that defines the driver.
+	Source string
 }
 
 var Drivers map[string]*Driver
@@ -25,9 +36,19 @@ var Drivers map[string]*Driver
 var DefaultDriver *Driver
 var DefaultDriverName = "default"
 
+// DefaultDriverTemplate is a template of the built-in default driver.
+// The drivers that extend it can override the "pre", "script" and "post" blocks.
+const DefaultDriverTemplate = `
+{{template "environment" .}}
+{{block "pre" .}}{{end}}
+{{block "script" .}}{{range $i, $script := .Scripts}}{{$script.code}}
+{{end}}{{end}}
+{{block "post" .}}{{end}}`
+
 func NewDriver() *Driver {
 	return &Driver{
 		Props:   map[string]interface{}{},
+		Blocks:  map[string]string{},
 		LValues: map[string]lua.LValue{},
 	}
 }
@@ -38,64 +59,180 @@ func (driver *Driver) MapLValuesToLTable(tb *lua.LTable) {
 	}
 }
 
-func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task, host *Host) (string, error) {
-	for key, value := range driver.LValues {
-		driver.Props[key] = toGoValue(value)
+// ParentDriver returns the driver that the driver extends.
+// If the driver extends the same name driver, the parent is the driver that was overridden by it.
+func (driver *Driver) ParentDriver() (*Driver, error) {
+	if driver.Extends == "" {
+		return nil, nil
 	}
 
-	if driver.Engine == nil {
-		return "", fmt.Errorf("invalid driver '%s'. The engine was not defined.", driver.Name)
+	var parent *Driver
+	if driver.Extends == driver.Name {
+		parent = driver.Child
+	} else {
+		parent = Drivers[driver.Extends]
 	}
 
-	templateText, err := driver.Engine(driver)
-	if err != nil {
-		return "", err
+	if parent == nil {
+		return nil, fmt.Errorf("driver '%s' extends undefined driver '%s'.", driver.Name, driver.Extends)
+	}
+
+	return parent, nil
+}
+
+// DriverTemplate is a template text of a driver in the inheritance chain.
+type DriverTemplate struct {
+	// Name is a name of the template. It is the driver's name, or the name with ".blocks" for the blocks.
+	Name string
+	Text string
+}
+
+// DriverTemplatePrefix prefixes the names of the drivers' templates in the template set,
+// so that the drivers named like "pre", "script" or "environment" don't collide with the blocks.
+const DriverTemplatePrefix = "essh.driver."
+
+// Templates returns the templates of the driver and its ancestors.
+// The root driver's templates come first, so the descendants' definitions override the ancestors' blocks.
+func (driver *Driver) Templates() ([]*DriverTemplate, error) {
+	templates := []*DriverTemplate{}
+	visited := map[*Driver]bool{}
+
+	for d := driver; d != nil; {
+		if visited[d] {
+			return nil, fmt.Errorf("driver '%s' has a circular inheritance.", driver.Name)
+		}
+		visited[d] = true
+
+		for key, value := range d.LValues {
+			d.Props[key] = toGoValue(value)
+		}
+
+		if d.Engine == nil && d.Extends == "" {
+			return nil, fmt.Errorf("invalid driver '%s'. The engine was not defined.", d.Name)
+		}
+
+		dTemplates := []*DriverTemplate{}
+		if d.Engine != nil {
+			text, err := d.Engine(d)
+			if err != nil {
+				return nil, err
+			}
+			dTemplates = append(dTemplates, &DriverTemplate{Name: d.Name, Text: text})
+		}
+
+		if len(d.Blocks) > 0 {
+			names := []string{}
+			for name := range d.Blocks {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			text := ""
+			for _, name := range names {
+				text += "{{define \"" + name + "\"}}" + d.Blocks[name] + "{{end}}"
+			}
+			dTemplates = append(dTemplates, &DriverTemplate{Name: d.Name + ".blocks", Text: text})
+		}
+
+		templates = append(dTemplates, templates...)
+
+		parent, err := d.ParentDriver()
+		if err != nil {
+			return nil, err
+		}
+		d = parent
 	}
 
+	return templates, nil
+}
+
+// TemplateData returns the data that is passed to the driver's template.
+func (driver *Driver) TemplateData(sshConfigPath string, task *Task, host *Host) (map[string]interface{}, error) {
 	scripts := []map[string]string{}
 	if task.File != "" {
 		tContent, err := GetContentFromPath(task.File)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		scripts = append(scripts, map[string]string{"code": string(tContent)})
 	} else {
 		scripts = task.Script
 	}
 
-	funcMap := template.FuncMap{
-		"ShellEscape":  ShellEscape,
-		"ToUpper":      strings.ToUpper,
-		"ToLower":      strings.ToLower,
-		"EnvKeyEscape": EnvKeyEscape,
-		"Add": func(x, y int) int {
-			return x + y
-		},
+	interpreter := Interpreters[driver.InterpreterName()]
+	if interpreter == nil {
+		return nil, fmt.Errorf("invalid interpreter '%s' in the driver '%s'", driver.InterpreterName(), driver.Name)
+	}
+	if task.Shell != "" {
+		// the environment is rendered by the syntax of the task's shell.
+		interpreter = ShellInterpreter(task.Shell)
 	}
 
-	dict := map[string]interface{}{
+	return map[string]interface{}{
 		"GOARCH":        runtime.GOARCH,
 		"GOOS":          runtime.GOOS,
 		"Debug":         debugFlag,
 		"Driver":        driver,
+		"Interpreter":   interpreter,
 		"Task":          task,
 		"Host":          host,
 		"Scripts":       scripts,
 		"SSHConfigPath": sshConfigPath,
-	}
+	}, nil
+}
 
-	baseTempl, err := template.New("base").Funcs(funcMap).Parse(templateText)
+func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task, host *Host) (string, error) {
+	templates, err := driver.Templates()
 	if err != nil {
 		return "", err
 	}
 
-	tmpl, err := baseTempl.Parse(EnvironmentTemplate)
+	dict, err := driver.TemplateData(sshConfigPath, task, host)
 	if err != nil {
 		return "", err
 	}
+	interpreter := dict["Interpreter"].(*Interpreter)
+
+	funcMap := template.FuncMap{
+		"Export":       interpreter.Export,
+		"Preamble":     func() string { return interpreter.Preamble },
+		"ShellEscape":  ShellEscape,
+		"ToUpper":      strings.ToUpper,
+		"ToLower":      strings.ToLower,
+		"EnvKeyEscape": EnvKeyEscape,
+		"FlattenProps": FlattenProps,
+		"PropString":   PropString,
+		"Add": func(x, y int) int {
+			return x + y
+		},
+	}
+
+	// every driver's template is parsed by its name, so that the errors point to the driver.
+	tmpl := template.New("essh").Funcs(funcMap)
+	for _, t := range templates {
+		if _, err := tmpl.New(DriverTemplatePrefix + t.Name).Parse(t.Text); err != nil {
+			return "", err
+		}
+	}
+
+	if _, err := tmpl.New("essh.environment").Parse(EnvironmentTemplate); err != nil {
+		return "", err
+	}
+
+	// the nearest driver's template that has a body other than the definitions is executed.
+	var body *template.Template
+	for i := len(templates) - 1; i >= 0; i-- {
+		if t := tmpl.Lookup(DriverTemplatePrefix + templates[i].Name); t != nil && t.Tree != nil && !parse.IsEmptyTree(t.Tree.Root) {
+			body = t
+			break
+		}
+	}
+	if body == nil {
+		return "", fmt.Errorf("invalid driver '%s'. The template has only definitions.", driver.Name)
+	}
 
 	var b bytes.Buffer
-	err = tmpl.Execute(&b, dict)
+	err = body.Execute(&b, dict)
 	if err != nil {
 		return "", err
 	}
@@ -103,29 +240,41 @@ func (driver *Driver) GenerateRunnableContent(sshConfigPath string, task *Task,
 	return b.String(), nil
 }
 
+// EnvironmentTemplate sets the environment variables by the syntax of the driver's interpreter.
 const EnvironmentTemplate = `{{define "environment" -}}
-export ESSH_TASK_NAME={{.Task.Name | ShellEscape}}
-export ESSH_SSH_CONFIG={{.SSHConfigPath}}
-export ESSH_DEBUG="{{if .Debug}}1{{end}}"
-{{range $key, $value := .Task.Props -}}
-export ESSH_TASK_PROPS_{{$key | ToUpper | EnvKeyEscape}}={{$value | ShellEscape }}
+{{with Preamble}}{{.}}
+{{end -}}
+{{Export "ESSH_TASK_NAME" .Task.Name}}
+{{Export "ESSH_SSH_CONFIG" .SSHConfigPath}}
+{{Export "ESSH_DEBUG" (or (and .Debug "1") "")}}
+{{range FlattenProps "ESSH_TASK_PROPS" .Task.Props -}}
+{{Export .Key .Value}}
 {{end -}}
 {{range $index, $value := .Task.Args -}}
-export ESSH_TASK_ARGS_{{Add $index 1 }}={{$value | ShellEscape }}
+{{Export (printf "ESSH_TASK_ARGS_%d" (Add $index 1)) $value}}
+{{end -}}
+{{range $key, $value := .Task.Env -}}
+{{Export $key $value}}
+{{end -}}
+{{if .Task.StepName -}}
+{{Export "ESSH_STEP_NAME" .Task.StepName}}
+{{end -}}
+{{range $key, $value := .Task.StepOutputs -}}
+{{Export (printf "ESSH_STEP_%s_OUTPUT" ($key | ToUpper | EnvKeyEscape)) $value}}
 {{end -}}
 {{if .Host -}}
-export ESSH_HOSTNAME={{.Host.Name | ShellEscape}}
-export ESSH_HOST_HOSTNAME={{.Host.Name | ShellEscape}}
+{{Export "ESSH_HOSTNAME" .Host.Name}}
+{{Export "ESSH_HOST_HOSTNAME" .Host.Name}}
 {{range $i, $kvpair := .Host.SortedSSHConfig -}}
 {{range $key, $value := $kvpair -}}
-export ESSH_HOST_SSH_{{$key | ToUpper}}={{$value | ShellEscape }}
+{{Export (printf "ESSH_HOST_SSH_%s" ($key | ToUpper)) $value}}
 {{end -}}
 {{end -}}
-{{range $key, $value := .Host.Props -}}
-export ESSH_HOST_PROPS_{{$key | ToUpper | EnvKeyEscape}}={{$value | ShellEscape }}
+{{range FlattenProps "ESSH_HOST_PROPS" .Host.Props -}}
+{{Export .Key .Value}}
 {{end -}}
 {{range $i, $value := .Host.Tags -}}
-export ESSH_HOST_TAGS_{{$value | ToUpper | EnvKeyEscape}}=1
+{{Export (printf "ESSH_HOST_TAGS_%s" ($value | ToUpper | EnvKeyEscape)) "1"}}
 {{end -}}
 {{end -}}
 {{end}}
@@ -183,6 +332,7 @@ func registerDriver(L *lua.LState, name string) *Driver {
 	d := NewDriver()
 	d.Name = name
 	d.Registry = CurrentRegistry
+	d.Source = definitionSource(L)
 
 	if driver := Drivers[d.Name]; driver != nil {
 		// detect same name driver
@@ -191,6 +341,7 @@ func registerDriver(L *lua.LState, name string) *Driver {
 	}
 
 	if EvaluatingModule != nil {
+		d.Module = EvaluatingModule
 		EvaluatingModule.Drivers = append(EvaluatingModule.Drivers, d)
 	}
 
@@ -239,6 +390,39 @@ func updateDriver(L *lua.LState, driver *Driver, key string, value lua.LValue) {
 		} else {
 			L.RaiseError("driver 'engine' have to be a function or string.")
 		}
+	case "interpreter":
+		interpreterStr, ok := toString(value)
+		if !ok {
+			L.RaiseError("driver 'interpreter' have to be a string.")
+		}
+		if Interpreters[interpreterStr] == nil {
+			L.RaiseError("driver 'interpreter' must be one of %s.", strings.Join(InterpreterNames(), ", "))
+		}
+		driver.Interpreter = interpreterStr
+	case "extends":
+		if extendsStr, ok := toString(value); ok {
+			driver.Extends = extendsStr
+		} else {
+			L.RaiseError("driver 'extends' have to be a string.")
+		}
+	case "blocks":
+		tb, ok := toLTable(value)
+		if !ok {
+			L.RaiseError("driver 'blocks' have to be a table.")
+		}
+
+		driver.Blocks = map[string]string{}
+		tb.ForEach(func(k, v lua.LValue) {
+			name, ok := toString(k)
+			if !ok {
+				L.RaiseError("driver 'blocks' have to be a table of strings.")
+			}
+			block, ok := toString(v)
+			if !ok {
+				L.RaiseError("driver 'blocks' have to be a table of strings.")
+			}
+			driver.Blocks[name] = block
+		})
 	}
 }
 
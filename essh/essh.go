@@ -16,10 +16,13 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"text/template"
+	"time"
 )
 
 // system configurations.
@@ -68,23 +71,52 @@ var (
 	bashCompletionTasksFlag      bool
 	bashCompletionNamespacesFlag bool
 
-	aliasesFlag     bool
-	execFlag        bool
-	fileFlag        bool
-	prefixFlag      bool
-	parallelFlag    bool
-	privilegedFlag  bool
-	userVar         string
-	ptyFlag         bool
-	SSHConfigFlag   bool
-	workindDirVar   string
-	configVar       string
-	selectVar       []string
-	targetVar       []string
-	filterVar       []string
-	backendVar      string
-	prefixStringVar string
-	driverVar       string
+	aliasesFlag         bool
+	execFlag            bool
+	fileFlag            bool
+	prefixFlag          bool
+	parallelFlag        bool
+	privilegedFlag      bool
+	userVar             string
+	ptyFlag             bool
+	SSHConfigFlag       bool
+	workindDirVar       string
+	configVar           string
+	selectVar           []string
+	targetVar           []string
+	filterVar           []string
+	backendVar          string
+	prefixStringVar     string
+	driverVar           string
+	yesFlag             bool
+	dryRunFlag          bool
+	forceUnlockFlag     bool
+	historyFlag         bool
+	historyShowVar      string
+	historyTaskVar      string
+	hostVar             string
+	failedFlag          bool
+	transportVar        string
+	muxStatusFlag       bool
+	muxCloseFlag        bool
+	renderFlag          bool
+	formatVar           string
+	explainVar          string
+	profileVar          string
+	encryptSecretFlag   bool
+	rotateSecretKeyFlag bool
+	offlineFlag         bool
+)
+
+var (
+	// commandArgs is the arguments that essh was invoked with.
+	commandArgs []string
+	// commandDir is the directory where essh was invoked.
+	commandDir string
+	// historyParentID is an id of the history record that is repeated by --rerun or --retry-failed.
+	historyParentID string
+	// retryHosts is names of the hosts that are retried by --retry-failed. nil means all the hosts.
+	retryHosts map[string]bool
 )
 
 const (
@@ -138,6 +170,34 @@ func initResources() {
 	backendVar = ""
 	prefixStringVar = ""
 	driverVar = ""
+	yesFlag = false
+	dryRunFlag = false
+	forceUnlockFlag = false
+	historyFlag = false
+	historyShowVar = ""
+	historyTaskVar = ""
+	hostVar = ""
+	failedFlag = false
+	transportVar = ""
+	muxStatusFlag = false
+	muxCloseFlag = false
+	renderFlag = false
+	formatVar = ""
+	explainVar = ""
+	profileVar = ""
+	encryptSecretFlag = false
+	offlineFlag = false
+	rotateSecretKeyFlag = false
+	commandArgs = []string{}
+	commandDir = ""
+	historyParentID = ""
+	retryHosts = nil
+
+	// Secrets
+	secretsMasked = false
+	sensitiveValues = []string{}
+	redactRegexps = nil
+	loadedConfigFiles = []string{}
 
 	// Registry
 	CurrentRegistry = nil
@@ -148,18 +208,35 @@ func initResources() {
 	Hosts = map[string]*Host{}
 	Tasks = map[string]*Task{}
 	Drivers = map[string]*Driver{}
+	Policies = []*Policy{}
+	Backends = map[string]*Backend{}
+
+	// Multiplexing
+	MultiplexDefault = false
+	MultiplexPersist = DefaultMultiplexPersist
 
 	// set built-in drivers
 	driver := NewDriver()
 	driver.Name = DefaultDriverName
 	driver.Engine = func(driver *Driver) (string, error) {
-		return `
-{{template "environment" .}}
-{{range $i, $script := .Scripts}}{{$script.code}}
-{{end}}`, nil
+		return DefaultDriverTemplate, nil
 	}
 	Drivers[DefaultDriverName] = driver
 	DefaultDriver = driver
+
+	// built-in drivers for the interpreters
+	for _, name := range InterpreterNames() {
+		if name == DefaultInterpreterName {
+			continue
+		}
+		d := NewDriver()
+		d.Name = name
+		d.Interpreter = name
+		d.Engine = func(driver *Driver) (string, error) {
+			return DefaultDriverTemplate, nil
+		}
+		Drivers[name] = d
+	}
 }
 
 func Run(osArgs []string) (exitStatus int) {
@@ -186,6 +263,18 @@ func Run(osArgs []string) (exitStatus int) {
 		debugFlag = true
 	}
 
+	if wd, err := os.Getwd(); err == nil {
+		commandDir = wd
+	}
+
+	// --rerun and --retry-failed replace the arguments before parsing them.
+	osArgs, err := resolveRerunArgs(osArgs)
+	if err != nil {
+		printError(err)
+		return ExitErr
+	}
+	commandArgs = append(commandArgs, osArgs...)
+
 	if len(osArgs) == 0 {
 		printUsage()
 		return
@@ -238,6 +327,15 @@ func Run(osArgs []string) (exitStatus int) {
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--select=") {
 			selectVar = append(selectVar, strings.Split(arg, "=")[1])
+		} else if arg == "--format" {
+			if len(osArgs) < 2 {
+				printError("--format reguires an argument.")
+				return ExitErr
+			}
+			formatVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--format=") {
+			formatVar = strings.Split(arg, "=")[1]
 		} else if arg == "--tags" {
 			tagsFlag = true
 		} else if arg == "--gen" {
@@ -296,6 +394,21 @@ func Run(osArgs []string) (exitStatus int) {
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--config=") {
 			configVar = strings.Split(arg, "=")[1]
+		} else if arg == "--encrypt-secret" {
+			encryptSecretFlag = true
+		} else if arg == "--rotate-secret-key" {
+			rotateSecretKeyFlag = true
+		} else if arg == "--profile" {
+			if len(osArgs) < 2 {
+				printError("--profile reguires an argument.")
+				return ExitErr
+			}
+			profileVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--profile=") {
+			profileVar = strings.Split(arg, "=")[1]
+		} else if arg == "--offline" {
+			offlineFlag = true
 		} else if arg == "--exec" {
 			execFlag = true
 		} else if arg == "--privileged" {
@@ -358,6 +471,67 @@ func Run(osArgs []string) (exitStatus int) {
 			osArgs = osArgs[1:]
 		} else if strings.HasPrefix(arg, "--backend=") {
 			backendVar = strings.Split(arg, "=")[1]
+		} else if arg == "--history" {
+			historyFlag = true
+		} else if arg == "--history-show" {
+			if len(osArgs) < 2 {
+				printError("--history-show reguires an argument.")
+				return ExitErr
+			}
+			historyShowVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--history-show=") {
+			historyShowVar = strings.Split(arg, "=")[1]
+		} else if arg == "--task" {
+			if len(osArgs) < 2 {
+				printError("--task reguires an argument.")
+				return ExitErr
+			}
+			historyTaskVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--task=") {
+			historyTaskVar = strings.Split(arg, "=")[1]
+		} else if arg == "--host" {
+			if len(osArgs) < 2 {
+				printError("--host reguires an argument.")
+				return ExitErr
+			}
+			hostVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--host=") {
+			hostVar = strings.Split(arg, "=")[1]
+		} else if arg == "--failed" {
+			failedFlag = true
+		} else if arg == "--transport" {
+			if len(osArgs) < 2 {
+				printError("--transport reguires an argument.")
+				return ExitErr
+			}
+			transportVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--transport=") {
+			transportVar = strings.Split(arg, "=")[1]
+		} else if arg == "--mux-status" {
+			muxStatusFlag = true
+		} else if arg == "--mux-close" {
+			muxCloseFlag = true
+		} else if arg == "--explain" {
+			if len(osArgs) < 2 {
+				printError("--explain reguires an argument.")
+				return ExitErr
+			}
+			explainVar = osArgs[1]
+			osArgs = osArgs[1:]
+		} else if strings.HasPrefix(arg, "--explain=") {
+			explainVar = strings.Split(arg, "=")[1]
+		} else if arg == "--render" {
+			renderFlag = true
+		} else if arg == "--force-unlock" {
+			forceUnlockFlag = true
+		} else if arg == "--dry-run" {
+			dryRunFlag = true
+		} else if arg == "--yes" {
+			yesFlag = true
 		} else if arg == "--script-file" {
 			fileFlag = true
 		} else if arg == "--pty" {
@@ -374,6 +548,16 @@ func Run(osArgs []string) (exitStatus int) {
 		osArgs = osArgs[1:]
 	}
 
+	if formatVar != "" && formatVar != "table" && formatVar != "json" {
+		printError("--format must be 'table' or 'json'.")
+		return ExitErr
+	}
+
+	if transportVar != "" && transportVar != TRANSPORT_SSH && transportVar != TRANSPORT_GO {
+		printError(fmt.Errorf("--transport must be '%s' or '%s'.", TRANSPORT_SSH, TRANSPORT_GO))
+		return ExitErr
+	}
+
 	if colorFlag {
 		fatihColor.NoColor = false
 	}
@@ -405,16 +589,61 @@ func Run(osArgs []string) (exitStatus int) {
 	WorkingDataDir = filepath.Join(wd, ".essh")
 	WorkingDirConfigFile = filepath.Join(wd, ".esshconfig.lua")
 
-	// This is for Backward Compatibility
-	if _, err := os.Stat(filepath.Join(wd, "esshconfig.lua")); err == nil {
-		WorkingDirConfigFile = filepath.Join(wd, "esshconfig.lua")
-	}
-
 	// use config file path from environment variable if it set.
 	if configVar == "" && os.Getenv("ESSH_CONFIG") != "" {
 		configVar = os.Getenv("ESSH_CONFIG")
 	}
 
+	// use profile from environment variable if it set.
+	if profileVar == "" && os.Getenv("ESSH_PROFILE") != "" {
+		profileVar = os.Getenv("ESSH_PROFILE")
+	}
+
+	if v := os.Getenv("ESSH_OFFLINE"); v != "" {
+		// "0" and "false" don't enable offline mode. --offline option enables it anyway.
+		offline, err := strconv.ParseBool(v)
+		if err != nil {
+			printError(fmt.Errorf("ESSH_OFFLINE must be a boolean like '1', 'true', '0' or 'false', but got '%s'.", v))
+			return ExitErr
+		}
+		if offline {
+			offlineFlag = true
+		}
+	}
+
+	if offlineFlag && updateFlag {
+		printError("--update can't be used in offline mode.")
+		return ExitErr
+	}
+
+	if profileVar != "" {
+		if err := validateProfileName(profileVar); err != nil {
+			printError(err)
+			return ExitErr
+		}
+	}
+
+	// search the project config file in the parent directories.
+	if configVar == "" {
+		if projectDir, configFile := findProjectDir(wd); configFile != "" {
+			if debugFlag {
+				fmt.Printf("[essh debug] found config file: %s\n", configFile)
+			}
+
+			// the project root is the working directory.
+			if projectDir != wd {
+				if err := os.Chdir(projectDir); err != nil {
+					printError(err)
+					return ExitErr
+				}
+			}
+
+			WorkingDir = projectDir
+			WorkingDataDir = filepath.Join(projectDir, ".essh")
+			WorkingDirConfigFile = configFile
+		}
+	}
+
 	// overwrite config file path by --config option.
 	if configVar != "" {
 		if filepath.IsAbs(configVar) {
@@ -457,6 +686,14 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	if encryptSecretFlag {
+		if err := encryptSecretFromStdin(); err != nil {
+			printError(err)
+			return ExitErr
+		}
+		return
+	}
+
 	if zshCompletionFlag {
 		s, err := sprintByTemplate(ZSH_COMPLETION)
 		if err != nil {
@@ -502,6 +739,7 @@ func Run(osArgs []string) (exitStatus int) {
 	// set up the lua state.
 	L := lua.NewState()
 	defer L.Close()
+	defer closeGoSSHClients()
 	InitLuaState(L)
 
 	if debugFlag {
@@ -537,6 +775,11 @@ func Run(osArgs []string) (exitStatus int) {
 	// set temporary ssh config file path
 	lessh.RawSetString("ssh_config", lua.LString(temporarySSHConfigFile))
 
+	if profileVar != "" {
+		lessh.RawSetString("profile", lua.LString(profileVar))
+	}
+	lessh.RawSetString("offline", lua.LBool(offlineFlag))
+
 	// user context
 	GlobalRegistry = NewRegistry(UserDataDir, RegistryTypeGlobal)
 	LocalRegistry = NewRegistry(WorkingDataDir, RegistryTypeLocal)
@@ -547,64 +790,29 @@ func Run(osArgs []string) (exitStatus int) {
 		return ExitErr
 	}
 
-	if _, err := os.Stat(WorkingDirConfigFile); err == nil {
+	if hasProjectConfig() {
 		// has working directroy config file
 
 		// change context to working dir context
 		CurrentRegistry = LocalRegistry
 
-		// load working directory config
-		if _, err := os.Stat(WorkingDirConfigFile); err == nil {
-			if debugFlag {
-				fmt.Printf("[essh debug] loading config file: %s\n", WorkingDirConfigFile)
-			}
-
-			if err := CurrentRegistry.MkDirs(); err != nil {
-				printError(err)
-				return ExitErr
-			}
-
-			if err := L.DoFile(WorkingDirConfigFile); err != nil {
-				printError(err)
-				return ExitErr
-			}
-
-			if err := evaluateModules(); err != nil {
-				printError(err)
-				return ExitErr
-			}
+		if err := CurrentRegistry.MkDirs(); err != nil {
+			printError(err)
+			return ExitErr
+		}
 
-			if debugFlag {
-				fmt.Printf("[essh debug] loaded config file: %s\n", WorkingDirConfigFile)
-			}
+		// load working directory config and conf.d
+		if err := loadConfigLayer(L, WorkingDirConfigFile, WorkingDataDir); err != nil {
+			printError(err)
+			return ExitErr
 		}
 	} else {
 		// does not have working directory config file
 
-		// load per-user configuration file.
-		if _, err := os.Stat(UserConfigFile); err == nil {
-			if debugFlag {
-				fmt.Printf("[essh debug] loading config file: %s\n", UserConfigFile)
-			}
-
-			if err := CurrentRegistry.MkDirs(); err != nil {
-				printError(err)
-				return ExitErr
-			}
-
-			if err := L.DoFile(UserConfigFile); err != nil {
-				printError(err)
-				return ExitErr
-			}
-
-			if err := evaluateModules(); err != nil {
-				printError(err)
-				return ExitErr
-			}
-
-			if debugFlag {
-				fmt.Printf("[essh debug] loaded config file: %s\n", UserConfigFile)
-			}
+		// load per-user configuration file and conf.d
+		if err := loadConfigLayer(L, UserConfigFile, UserDataDir); err != nil {
+			printError(err)
+			return ExitErr
 		}
 	}
 
@@ -613,23 +821,10 @@ func Run(osArgs []string) (exitStatus int) {
 
 	// load working directory override config
 	if _, err := os.Stat(WorkingDirOverrideConfigFile); err == nil {
-		if debugFlag {
-			fmt.Printf("[essh debug] loading config file: %s\n", WorkingDirOverrideConfigFile)
-		}
-
-		if err := L.DoFile(WorkingDirOverrideConfigFile); err != nil {
-			printError(err)
-			return ExitErr
-		}
-
-		if err := evaluateModules(); err != nil {
+		if err := loadConfigFile(L, WorkingDirOverrideConfigFile); err != nil {
 			printError(err)
 			return ExitErr
 		}
-
-		if debugFlag {
-			fmt.Printf("[essh debug] loaded config file: %s\n", WorkingDirOverrideConfigFile)
-		}
 	}
 
 	// change context to global
@@ -637,28 +832,25 @@ func Run(osArgs []string) (exitStatus int) {
 
 	// load override global config
 	if _, err := os.Stat(UserOverrideConfigFile); err == nil {
-		if debugFlag {
-			fmt.Printf("[essh debug] loading config file: %s\n", UserOverrideConfigFile)
-		}
-
 		if err := CurrentRegistry.MkDirs(); err != nil {
 			printError(err)
 			return ExitErr
 		}
 
-		if err := L.DoFile(UserOverrideConfigFile); err != nil {
+		if err := loadConfigFile(L, UserOverrideConfigFile); err != nil {
 			printError(err)
 			return ExitErr
 		}
+	}
 
-		if err := evaluateModules(); err != nil {
-			printError(err)
-			return ExitErr
-		}
+	if err := loadMultiplexConfig(lessh); err != nil {
+		printError(err)
+		return ExitErr
+	}
 
-		if debugFlag {
-			fmt.Printf("[essh debug] loaded config file: %s\n", UserOverrideConfigFile)
-		}
+	if err := loadRedactConfig(lessh); err != nil {
+		printError(err)
+		return ExitErr
 	}
 
 	// validate config
@@ -741,7 +933,14 @@ func Run(osArgs []string) (exitStatus int) {
 
 			// print generated config
 			fmt.Println(string(content))
+		} else if formatVar == "json" {
+			if err := printHostsJSON(filteredHosts); err != nil {
+				printError(err)
+				return ExitErr
+			}
 		} else {
+			printProfileHeader()
+
 			tb := helper.NewPlainTable(os.Stdout)
 			if !quietFlag {
 				tb.SetHeader([]string{"NAME", "DESCRIPTION", "TAGS", "HIDDEN"})
@@ -781,6 +980,8 @@ func Run(osArgs []string) (exitStatus int) {
 
 	// only print tasks list
 	if tasksFlag {
+		printProfileHeader()
+
 		tb := helper.NewPlainTable(os.Stdout)
 		if !quietFlag {
 			tb.SetHeader([]string{"NAME", "DESCRIPTION", "HIDDEN"})
@@ -800,6 +1001,44 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	if rotateSecretKeyFlag {
+		if err := rotateSecretKey(loadedConfigFiles); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	// only print the definitions
+	if explainVar != "" {
+		if err := explain(explainVar); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	// only print history
+	if historyFlag {
+		if err := printHistory(historyTaskVar, hostVar, failedFlag); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	if historyShowVar != "" {
+		if err := printHistoryRecord(historyShowVar); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
 	outputConfig, ok := toString(lessh.RawGetString("ssh_config"))
 	if !ok {
 		printError(fmt.Errorf("invalid value %v in the 'ssh_config'", lessh.RawGetString("ssh_config")))
@@ -824,6 +1063,81 @@ func Run(osArgs []string) (exitStatus int) {
 		return
 	}
 
+	if muxStatusFlag || muxCloseFlag {
+		if len(selectVar) == 0 && len(filterVar) > 0 {
+			printError("--filter must be used with --select option.")
+			return ExitErr
+		}
+
+		hosts := NewHostQuery().AppendSelections(selectVar).AppendFilters(filterVar).GetHostsOrderByName()
+		if muxCloseFlag {
+			err = closeMux(outputConfig, hosts)
+		} else {
+			err = printMuxStatus(outputConfig, hosts)
+		}
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	if renderFlag {
+		if len(args) == 0 {
+			printError("--render requires a task name.")
+			return ExitErr
+		}
+
+		task := GetEnabledTask(args[0])
+		if task == nil {
+			printError(fmt.Errorf("task '%s' is not found.", args[0]))
+			return ExitErr
+		}
+
+		var host *Host
+		if hostVar != "" {
+			host = Hosts[hostVar]
+			if host == nil {
+				printError(fmt.Errorf("host '%s' is not found.", hostVar))
+				return ExitErr
+			}
+		}
+
+		if err := renderTask(L, outputConfig, task, host, args[1:]); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
+	if forceUnlockFlag {
+		if len(args) == 0 {
+			printError("--force-unlock requires a task name.")
+			return ExitErr
+		}
+
+		task := GetEnabledTask(args[0])
+		if task == nil {
+			printError(fmt.Errorf("task '%s' is not found.", args[0]))
+			return ExitErr
+		}
+
+		lock, err := NewTaskLock(L, outputConfig, task, getAllTaskHosts(task))
+		if err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		if err := lock.ForceRelease(); err != nil {
+			printError(err)
+			return ExitErr
+		}
+
+		return
+	}
+
 	// select running mode and run it.
 	if execFlag {
 		if len(args) == 0 {
@@ -871,7 +1185,7 @@ func Run(osArgs []string) (exitStatus int) {
 		err := runTask(outputConfig, task, []string{}, L)
 		if err != nil {
 			printError(err)
-			return ExitErr
+			return exitStatusOf(err)
 		}
 
 		return
@@ -891,7 +1205,7 @@ func Run(osArgs []string) (exitStatus int) {
 				err := runTask(outputConfig, task, taskargs, L)
 				if err != nil {
 					printError(err)
-					return ExitErr
+					return exitStatusOf(err)
 				}
 				return
 			}
@@ -944,49 +1258,227 @@ func UpdateSSHConfig(outputConfig string, enabledHosts []*Host) ([]byte, error)
 func runTask(config string, task *Task, args []string, L *lua.LState) error {
 	if debugFlag {
 		fmt.Printf("[essh debug] run task: %s\n", task.Name)
-		fmt.Printf("[essh debug] task's args: %v\n", args)
-	}
-
-	if task.Registry != nil {
-		// change current registry
-		CurrentRegistry = task.Registry
+		fmt.Printf("[essh debug] task's args: %v\n", redactArgs(args, task.Sensitive, task.SensitiveArgs))
 	}
 
-	// compose args
-	argstb := L.NewTable()
-	for i := 0; i < len(args); i++ {
-		L.RawSet(argstb, lua.LNumber(i+1), lua.LString(args[i]))
-	}
-	updateTask(L, task, "args", argstb)
+	setTaskArgs(L, task, args)
+	collectSensitiveValues(task, nil)
 
-	if task.Prepare != nil {
-		if debugFlag {
-			fmt.Printf("[essh debug] run task's prepare function.\n")
-		}
+	hosts := getAllTaskHosts(task)
 
-		err := task.Prepare()
+	if dryRunFlag {
+		decisions, err := evaluatePolicies(L, task, hosts, args)
 		if err != nil {
 			return err
 		}
+
+		printDryRun(L, task, hosts, decisions)
+		return deniedPoliciesError(decisions)
 	}
 
-	// get target hosts.
-	if task.IsRemoteTask() {
-		// run remotely.
-		var hosts []*Host
-		if len(task.TargetsSlice()) == 0 {
-			hosts = []*Host{}
-		} else {
-			hosts = NewHostQuery().
-				AppendSelections(task.TargetsSlice()).
-				AppendFilters(task.FiltersSlice()).
-				GetHostsOrderByName()
-		}
+	// all the invocations are recorded even if the task is denied, cancelled or locked.
+	record := NewHistoryRecord(task, args, hosts)
+	task.History = record
 
-		if len(hosts) == 0 {
+	outcome, err := runTaskWithGates(config, task, hosts, args, L)
+
+	record.Outcome = outcome
+	record.Finish(err)
+	if herr := SaveHistoryRecord(L, record); herr != nil {
+		printError(fmt.Errorf("failed to save the history: %v", herr))
+	}
+
+	return err
+}
+
+// runTaskWithGates runs the task if the policies, the confirmation and the lock allow it.
+// If the task doesn't run by them, it returns the outcome for the history.
+func runTaskWithGates(config string, task *Task, hosts []*Host, args []string, L *lua.LState) (string, error) {
+	outcome, lock, err := gateTask(config, task, hosts, args, L)
+	defer func() {
+		task.AcquiredLock = nil
+		if lock != nil {
+			lock.Release()
+		}
+	}()
+	if err != nil {
+		return outcome, err
+	}
+
+	// the prepare function runs after the confirmation, so that its side effects don't happen if the user cancels.
+	if err := prepareTask(L, task); err != nil {
+		return "", err
+	}
+
+	// the prepare function can choose the target hosts. The new hosts are checked by the gates again.
+	if newHosts := getAllTaskHosts(task); !sameHosts(hosts, newHosts) {
+		if debugFlag {
+			fmt.Printf("[essh debug] task's prepare function changed the target hosts.\n")
+		}
+
+		if task.History != nil {
+			task.History.SetHosts(newHosts)
+		}
+
+		// the lock file is named by the task. So it must be released before locking the new hosts.
+		if lock != nil {
+			lock.Release()
+			lock = nil
+		}
+
+		outcome, lock, err = gateTask(config, task, newHosts, args, L)
+		if err != nil {
+			return outcome, err
+		}
+	}
+	task.AcquiredLock = lock
+
+	if err := task.ResolveEnv(); err != nil {
+		return "", err
+	}
+	collectSensitiveValues(task, nil)
+
+	if len(task.Steps) > 0 {
+		return "", runTaskSteps(config, task)
+	}
+
+	return "", executeTask(config, task)
+}
+
+// gateTask checks the policies, the confirmation and the lock for the hosts.
+// It returns the acquired lock that the caller must release.
+func gateTask(config string, task *Task, hosts []*Host, args []string, L *lua.LState) (string, *TaskLock, error) {
+	decisions, err := evaluatePolicies(L, task, hosts, args)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := deniedPoliciesError(decisions); err != nil {
+		return HISTORY_OUTCOME_DENIED, nil, err
+	}
+
+	if err := confirmTask(L, task, hosts, decisions); err != nil {
+		return HISTORY_OUTCOME_CANCELLED, nil, err
+	}
+
+	if task.Lock == "" {
+		return "", nil, nil
+	}
+
+	lock, err := NewTaskLock(L, config, task, hosts)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if err := lock.Acquire(); err != nil {
+		return HISTORY_OUTCOME_LOCKED, nil, err
+	}
+
+	return "", lock, nil
+}
+
+// setTaskArgs sets the arguments to the task.
+func setTaskArgs(L *lua.LState, task *Task, args []string) {
+	if task.Registry != nil {
+		// change current registry
+		CurrentRegistry = task.Registry
+	}
+
+	// compose args
+	argstb := L.NewTable()
+	for i := 0; i < len(args); i++ {
+		L.RawSet(argstb, lua.LNumber(i+1), lua.LString(args[i]))
+	}
+	updateTask(L, task, "args", argstb)
+}
+
+// prepareTask runs the prepare function.
+func prepareTask(L *lua.LState, task *Task) error {
+	if task.Prepare == nil {
+		return nil
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] run task's prepare function.\n")
+	}
+
+	return task.Prepare()
+}
+
+func sameHosts(a []*Host, b []*Host) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return false
+		}
+	}
+
+	return true
+}
+
+func printDryRun(L *lua.LState, task *Task, hosts []*Host, decisions []*PolicyDecision) {
+	fmt.Printf("task: %s\n", task.Name)
+	if len(task.Steps) > 0 {
+		for i, step := range task.Steps {
+			fmt.Printf("step %d: %s (backend: %s)\n", i+1, step.StepName, step.Backend)
+		}
+	} else {
+		fmt.Printf("backend: %s\n", task.Backend)
+	}
+
+	if len(task.Args) > 0 {
+		fmt.Printf("args: %s\n", strings.Join(redactArgs(task.Args, task.Sensitive, task.SensitiveArgs), " "))
+	}
+
+	hostNames := []string{}
+	for _, host := range hosts {
+		hostNames = append(hostNames, host.Name)
+	}
+	fmt.Printf("hosts (%d): %s\n", len(hosts), strings.Join(hostNames, ", "))
+
+	for _, d := range decisions {
+		if d.Reason != "" {
+			fmt.Printf("policy '%s': %s (%s)\n", d.Policy.Name, d.Action, d.Reason)
+		} else {
+			fmt.Printf("policy '%s': %s\n", d.Policy.Name, d.Action)
+		}
+	}
+
+	c, err := newTaskConfirmation(L, task, hosts, decisions)
+	if err != nil {
+		fmt.Printf("confirmation: %v\n", err)
+	} else if c != nil {
+		fmt.Printf("confirmation: required\n")
+	} else {
+		fmt.Printf("confirmation: not required\n")
+	}
+}
+
+func executeTask(config string, task *Task) error {
+	if retryHosts != nil && len(task.TargetsSlice()) > 0 && len(getTaskHosts(task)) == 0 {
+		// a step that did not fail in the retried run.
+		if debugFlag {
+			fmt.Printf("[essh debug] skip the task that has no failed hosts: %s %s\n", task.Name, task.StepName)
+		}
+		return nil
+	}
+
+	// get target hosts.
+	if task.IsRemoteTask() || task.IsBackendTask() {
+		// run remotely or by the user defined backend.
+		hosts := getTaskHosts(task)
+
+		if len(hosts) == 0 {
 			return fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
 		}
 
+		if err := validateTransfers(task, hosts); err != nil {
+			return err
+		}
+
 		// see https://github.com/kohkimakimoto/essh/issues/38
 		//// handle stdin
 		stdinChs := make([]chan ([]byte), len(hosts))
@@ -1003,16 +1495,20 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 			if task.Parallel {
 				wg.Add(1)
 				go func(host *Host) {
-					err := runRemoteTaskScript(config, task, host, hosts, stdinChs[i], m)
+					err := runTaskOnHost(config, task, host, hosts, stdinChs[i], m)
 					if err != nil {
 						fmt.Fprintf(os.Stderr, color.FgRB("essh error: %v\n", err))
+						// the run aborts at the first failure. save the history before it.
+						task.History.Abort(err)
+						// the deferred release doesn't run by the panic.
+						task.AcquiredLock.Release()
 						panic(err)
 					}
 
 					wg.Done()
 				}(host)
 			} else {
-				err := runRemoteTaskScript(config, task, host, hosts, stdinChs[i], m)
+				err := runTaskOnHost(config, task, host, hosts, stdinChs[i], m)
 				if err != nil {
 					return err
 				}
@@ -1021,27 +1517,25 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 		wg.Wait()
 	} else {
 		// run locally.
-		var hosts []*Host
-		if len(task.TargetsSlice()) == 0 {
-			hosts = []*Host{}
-		} else {
-			hosts = NewHostQuery().
-				AppendSelections(task.TargetsSlice()).
-				AppendFilters(task.FiltersSlice()).
-				GetHostsOrderByName()
-		}
+		hosts := getTaskHosts(task)
 
 		if len(task.Targets) >= 1 && len(hosts) == 0 {
 			return fmt.Errorf("There are not hosts to run the command. you must specify the valid hosts.")
 		}
 
+		if err := validateTransfers(task, hosts); err != nil {
+			return err
+		}
+
 		wg := &sync.WaitGroup{}
 		m := new(sync.Mutex)
 
 		if len(hosts) == 0 {
 			// local no host task
 			// This pattern should run just exec. should not use magic to pipe stdin to multi targets.
+			start := time.Now()
 			err := runLocalTaskScript(config, task, nil, hosts, nil, m)
+			task.History.AddResult(task, nil, time.Since(start), err)
 			if err != nil {
 				return err
 			}
@@ -1062,16 +1556,20 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 			if task.Parallel {
 				wg.Add(1)
 				go func(host *Host) {
-					err := runLocalTaskScript(config, task, host, hosts, stdinChs[i], m)
+					err := runTaskOnHost(config, task, host, hosts, stdinChs[i], m)
 					if err != nil {
 						fmt.Fprintf(os.Stderr, color.FgRB("essh error: %v\n", err))
+						// the run aborts at the first failure. save the history before it.
+						task.History.Abort(err)
+						// the deferred release doesn't run by the panic.
+						task.AcquiredLock.Release()
 						panic(err)
 					}
 
 					wg.Done()
 				}(host)
 			} else {
-				err := runLocalTaskScript(config, task, host, hosts, stdinChs[i], m)
+				err := runTaskOnHost(config, task, host, hosts, stdinChs[i], m)
 				if err != nil {
 					return err
 				}
@@ -1083,220 +1581,215 @@ func runTask(config string, task *Task, args []string, L *lua.LState) error {
 	return nil
 }
 
-func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
-	// setup ssh command args
-	var sshCommandArgs []string
-	if task.Pty {
-		sshCommandArgs = []string{"-t", "-t", "-F", sshConfigPath, host.Name}
-	} else {
-		sshCommandArgs = []string{"-F", sshConfigPath, host.Name}
-	}
-
-	// generate commands by using driver
-	if task.Driver == "" {
-		task.Driver = DefaultDriverName
-	}
-
-	driver := Drivers[task.Driver]
-	if driver == nil {
-		return fmt.Errorf("invalid driver name '%s'", task.Driver)
+func getTaskHosts(task *Task) []*Host {
+	if len(task.TargetsSlice()) == 0 {
+		return []*Host{}
 	}
 
-	if debugFlag {
-		fmt.Printf("[essh debug] driver: %s \n", driver.Name)
-	}
+	return restrictRetryHosts(NewHostQuery().
+		AppendSelections(task.TargetsSlice()).
+		AppendFilters(task.FiltersSlice()).
+		GetHostsOrderByName())
+}
 
-	var script string
-	content, err := driver.GenerateRunnableContent(sshConfigPath, task, host)
-	if err != nil {
-		return err
+// getAllTaskHosts returns target hosts of the task and its steps.
+func getAllTaskHosts(task *Task) []*Host {
+	if len(task.Steps) == 0 {
+		return getTaskHosts(task)
 	}
-	script += content
 
-	if task.User != "" {
-		script = "sudo -u " + ShellEscape(task.User) + " bash -l -c " + ShellEscape(script)
-	} else if task.Privileged {
-		script = "sudo bash -l -c " + ShellEscape(script)
+	hostsMap := map[string]*Host{}
+	for _, step := range task.Steps {
+		for _, host := range getTaskHosts(step) {
+			hostsMap[host.Name] = host
+		}
 	}
 
-	sshCommandArgs = append(sshCommandArgs, "bash", "-c", ShellEscape(script))
-
-	cmd := exec.Command("ssh", sshCommandArgs[:]...)
-	if debugFlag {
-		fmt.Printf("[essh debug] real ssh command: %v \n", cmd.Args)
+	hosts := []*Host{}
+	for _, host := range hostsMap {
+		hosts = append(hosts, host)
 	}
+	sort.Sort(NameSortableHosts(hosts))
 
-	prefix := ""
-	if task.UsePrefix {
-		prefixTmp := task.Prefix
-		if prefixTmp == "" {
-			if task.IsRemoteTask() {
-				prefixTmp = DefaultPrefixRemote
-			} else {
-				prefixTmp = DefaultPrefixLocal
-			}
-		}
+	return hosts
+}
 
-		funcMap := template.FuncMap{
-			"ShellEscape":         ShellEscape,
-			"ToUpper":             strings.ToUpper,
-			"ToLower":             strings.ToLower,
-			"EnvKeyEscape":        EnvKeyEscape,
-			"HostnameAlignString": HostnameAlignString(host, hosts),
-		}
+func runTaskOnHost(config string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+	start := time.Now()
+	err := runTaskOnHostWithoutHistory(config, task, host, hosts, stdinCh, m)
+	task.History.AddResult(task, host, time.Since(start), err)
 
-		dict := map[string]interface{}{
-			"Host": host,
-			"Task": task,
-		}
-		tmpl, err := template.New("T").Funcs(funcMap).Parse(prefixTmp)
-		if err != nil {
-			return err
-		}
-		var b bytes.Buffer
-		err = tmpl.Execute(&b, dict)
-		if err != nil {
-			return err
-		}
+	return err
+}
 
-		prefix = b.String()
+func runTaskOnHostWithoutHistory(config string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+	if err := runTaskUploads(config, task, host, hosts, m); err != nil {
+		return err
 	}
 
-	// cmd.Stdin = os.Stdin
-
-	// see https://github.com/kohkimakimoto/essh/issues/38
-	if stdinCh == nil {
-		cmd.Stdin = os.Stdin
-	} else {
-		stdin, err := cmd.StdinPipe()
-		if err != nil {
-			return err
+	if task.HasScript() {
+		var err error
+		if task.IsRemoteTask() && task.TransportOrDefault() == TRANSPORT_GO {
+			err = runRemoteTaskScriptWithGoSSH(config, task, host, hosts, stdinCh, m)
+		} else if task.IsBackendTask() {
+			err = runBackendTaskScript(config, task, host, hosts, stdinCh, m)
+		} else if task.IsRemoteTask() {
+			err = runRemoteTaskScript(config, task, host, hosts, stdinCh, m)
+		} else {
+			err = runLocalTaskScript(config, task, host, hosts, stdinCh, m)
 		}
-		go handleInput(stdinCh, stdin)
-	}
-
-	wg := &sync.WaitGroup{}
-	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stdout = os.Stdout
-	} else {
-		stdout, err := cmd.StdoutPipe()
 		if err != nil {
 			return err
 		}
-		wg.Add(1)
+	} else if stdinCh != nil {
+		// nothing reads stdin. discard it not to block the other hosts.
 		go func() {
-			scanLines(stdout, os.Stdout, prefix, m)
-			wg.Done()
+			for range stdinCh {
+			}
 		}()
 	}
 
-	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stderr = os.Stderr
+	return runTaskDownloads(config, task, host, hosts, m)
+}
+
+func runRemoteTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+	// setup ssh command args
+	var sshCommandArgs []string
+	if task.Pty {
+		sshCommandArgs = []string{"-t", "-t", "-F", sshConfigPath, host.Name}
 	} else {
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			return err
-		}
-		wg.Add(1)
-		go func() {
-			scanLines(stderr, os.Stderr, prefix, m)
-			wg.Done()
-		}()
+		sshCommandArgs = []string{"-F", sshConfigPath, host.Name}
 	}
 
-	err = cmd.Start()
+	command, input, err := remoteTaskCommand(sshConfigPath, task, host)
 	if err != nil {
 		return err
 	}
+	if input != nil {
+		stdinCh = prependStdin(input, stdinCh)
+	}
 
-	wg.Wait()
-
-	return cmd.Wait()
-}
+	sshCommandArgs = append(sshCommandArgs, command)
 
-func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
-	var shell, flag string
-	if runtime.GOOS == "windows" {
-		shell = "cmd"
-		flag = "/C"
-	} else {
-		shell = "bash"
-		flag = "-c"
+	cmd := exec.Command("ssh", sshCommandArgs[:]...)
+	if debugFlag {
+		fmt.Printf("[essh debug] real ssh command: %v \n", redact(fmt.Sprint(cmd.Args)))
 	}
 
-	// generate commands by using driver
+	return runTaskCommand(cmd, task, host, hosts, stdinCh, m)
+}
+
+// renderTaskScript generates the task's script for the host by using the driver.
+func renderTaskScript(sshConfigPath string, task *Task, host *Host) (string, error) {
 	if task.Driver == "" {
 		task.Driver = DefaultDriverName
 	}
 
 	driver := Drivers[task.Driver]
 	if driver == nil {
-		return fmt.Errorf("invalid driver name '%s'", task.Driver)
+		return "", fmt.Errorf("invalid driver name '%s'", task.Driver)
 	}
 
 	if debugFlag {
 		fmt.Printf("[essh debug] driver: %s \n", driver.Name)
 	}
 
-	var script string
-	content, err := driver.GenerateRunnableContent(sshConfigPath, task, host)
+	// the sensitive values are redacted in the debug outputs and the history.
+	collectSensitiveValues(task, host)
+
+	script, err := driver.GenerateRunnableContent(sshConfigPath, task, host)
 	if err != nil {
-		return err
+		return "", err
+	}
+	task.History.SetScriptHash(task, host, script)
+
+	return script, nil
+}
+
+// remoteTaskCommand generates a command line that runs the task's script on the remote host.
+// If the script is not passed as an argument, it returns the input that must be sent through stdin before the user's input.
+func remoteTaskCommand(sshConfigPath string, task *Task, host *Host) (string, []byte, error) {
+	script, err := renderTaskScript(sshConfigPath, task, host)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var command string
+	var input []byte
+	login := task.User != "" || task.Privileged
+	if scriptTransport := task.ScriptTransportOrDefault(); scriptTransport == SCRIPT_TRANSPORT_ARGV {
+		command = task.ShellCommandLine(login) + " " + ShellEscape(script)
+	} else {
+		if task.Pty {
+			return "", nil, fmt.Errorf("script_transport '%s' can't be used with pty.", scriptTransport)
+		}
+
+		bootstrap, err := scriptBootstrap(task, len(script), login)
+		if err != nil {
+			return "", nil, err
+		}
+		command = "sh -c " + ShellEscape(bootstrap)
+		input = []byte(script)
 	}
-	script += content
 
 	if task.User != "" {
-		script = "cd " + WorkingDir + "\n" + script
-		script = "sudo -u " + ShellEscape(task.User) + " bash -l -c " + ShellEscape(script)
+		command = "sudo -u " + ShellEscape(task.User) + " " + command
 	} else if task.Privileged {
-		script = "cd " + WorkingDir + "\n" + script
-		script = "sudo bash -l -c " + ShellEscape(script)
+		command = "sudo " + command
 	}
 
-	cmd := exec.Command(shell, flag, script)
-	if debugFlag {
-		fmt.Printf("[essh debug] real local command: %v \n", cmd.Args)
+	if task.Dir != "" {
+		command = "cd " + ShellEscape(task.Dir) + " && " + command
 	}
 
-	prefix := ""
-	if host == nil && task.UsePrefix {
-		// simple local task (does not specify the hosts)
-		// prevent to use invalid text template.
-		// replace prefix string to the string that is not included "{{.Host}}"
-		prefix = "[local] "
-	} else if task.UsePrefix {
-		prefixTmp := task.Prefix
-		if prefixTmp == "" {
-			if task.IsRemoteTask() {
-				prefixTmp = DefaultPrefixRemote
-			} else {
-				prefixTmp = DefaultPrefixLocal
-			}
-		}
+	return command, input, nil
+}
 
-		funcMap := template.FuncMap{
-			"ShellEscape":         ShellEscape,
-			"ToUpper":             strings.ToUpper,
-			"ToLower":             strings.ToLower,
-			"EnvKeyEscape":        EnvKeyEscape,
-			"HostnameAlignString": HostnameAlignString(host, hosts),
-		}
+func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+	interpreter, err := task.Interpreter()
+	if err != nil {
+		return err
+	}
 
-		dict := map[string]interface{}{
-			"Host": host,
-			"Task": task,
-		}
-		tmpl, err := template.New("T").Funcs(funcMap).Parse(prefixTmp)
-		if err != nil {
-			return err
+	var shellArgs []string
+	if runtime.GOOS == "windows" && task.Shell == "" && interpreter.Name == DefaultInterpreterName {
+		shellArgs = []string{"cmd", "/C"}
+	} else {
+		shellArgs = strings.Fields(task.ShellCommandLine(false))
+	}
+
+	script, err := renderTaskScript(sshConfigPath, task, host)
+	if err != nil {
+		return err
+	}
+
+	dir := task.LocalDir()
+	if task.User != "" || task.Privileged {
+		if task.Shell == "" && interpreter.Shell {
+			script = "cd " + ShellEscape(dir) + "\n" + script
 		}
-		var b bytes.Buffer
-		err = tmpl.Execute(&b, dict)
-		if err != nil {
-			return err
+
+		if task.User != "" {
+			shellArgs = append([]string{"sudo", "-u", task.User}, strings.Fields(task.ShellCommandLine(true))...)
+		} else {
+			shellArgs = append([]string{"sudo"}, strings.Fields(task.ShellCommandLine(true))...)
 		}
+	}
+
+	cmd := exec.Command(shellArgs[0], append(shellArgs[1:], script)...)
+	cmd.Dir = dir
+	if debugFlag {
+		fmt.Printf("[essh debug] real local command: %v \n", redact(fmt.Sprint(cmd.Args)))
+	}
 
-		prefix = b.String()
+	return runTaskCommand(cmd, task, host, hosts, stdinCh, m)
+}
+
+// runTaskCommand runs the command of the task with the stdin fan-out and the output prefix.
+func runTaskCommand(cmd *exec.Cmd, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+	prefix, err := taskPrefix(task, host, hosts)
+	if err != nil {
+		return err
 	}
 
 	// cmd.Stdin = os.Stdin
@@ -1314,7 +1807,7 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 
 	wg := &sync.WaitGroup{}
 	if len(hosts) <= 1 && prefix == "" {
-		cmd.Stdout = os.Stdout
+		cmd.Stdout = task.StdoutWriter()
 	} else {
 		stdout, err := cmd.StdoutPipe()
 		if err != nil {
@@ -1322,7 +1815,7 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 		}
 		wg.Add(1)
 		go func() {
-			scanLines(stdout, os.Stdout, prefix, m)
+			scanLines(task.TeeOutput(stdout), os.Stdout, prefix, m)
 			wg.Done()
 		}()
 	}
@@ -1351,6 +1844,68 @@ func runLocalTaskScript(sshConfigPath string, task *Task, host *Host, hosts []*H
 	return cmd.Wait()
 }
 
+func taskPrefix(task *Task, host *Host, hosts []*Host) (string, error) {
+	if !task.UsePrefix {
+		if task.StepName != "" {
+			// steps always output with the step name.
+			return "[" + task.StepName + "] ", nil
+		}
+		return "", nil
+	}
+
+	stepPrefix := ""
+	if task.StepName != "" {
+		stepPrefix = "[" + task.StepName + "]"
+	}
+	if profileVar != "" && task.Prefix == "" {
+		// the default prefix shows the active profile.
+		stepPrefix = "[" + profileVar + "]" + stepPrefix
+	}
+
+	if host == nil {
+		// simple local task (does not specify the hosts)
+		// prevent to use invalid text template.
+		// replace prefix string to the string that is not included "{{.Host}}"
+		return stepPrefix + "[local] ", nil
+	}
+
+	prefixTmp := task.Prefix
+	if prefixTmp == "" {
+		if task.IsRemoteTask() {
+			prefixTmp = DefaultPrefixRemote
+		} else if task.IsBackendTask() {
+			prefixTmp = `[` + task.Backend + `:{{.Host.Name}}]{{HostnameAlignString " "}}`
+		} else {
+			prefixTmp = DefaultPrefixLocal
+		}
+	}
+
+	funcMap := template.FuncMap{
+		"ShellEscape":         ShellEscape,
+		"ToUpper":             strings.ToUpper,
+		"ToLower":             strings.ToLower,
+		"EnvKeyEscape":        EnvKeyEscape,
+		"HostnameAlignString": HostnameAlignString(host, hosts),
+	}
+
+	dict := map[string]interface{}{
+		"Host":    host,
+		"Task":    task,
+		"Profile": profileVar,
+	}
+	tmpl, err := template.New("T").Funcs(funcMap).Parse(prefixTmp)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, dict)
+	if err != nil {
+		return "", err
+	}
+
+	return redact(stepPrefix + b.String()), nil
+}
+
 // this code is borrowed from https://github.com/fujiwara/nssh/blob/master/nssh.go
 func processStdin(chs []chan []byte) {
 	buf := make([]byte, 1024)
@@ -1362,8 +1917,11 @@ func processStdin(chs []chan []byte) {
 			}
 			break
 		}
+		// copy the data because the buffer is reused before the hosts write it.
+		b := make([]byte, n)
+		copy(b, buf[0:n])
 		for _, ch := range chs {
-			ch <- buf[0:n]
+			ch <- b
 		}
 	}
 
@@ -1398,7 +1956,7 @@ func handleInput(stdinCh chan []byte, dest io.WriteCloser) {
 }
 
 // this code is borrowed from https://github.com/fujiwara/nssh/blob/master/nssh.go
-func scanLines(src io.ReadCloser, dest io.Writer, prefix string, m *sync.Mutex) {
+func scanLines(src io.Reader, dest io.Writer, prefix string, m *sync.Mutex) {
 	scanner := bufio.NewScanner(src)
 	for scanner.Scan() {
 		// prevent mixing data in a line.
@@ -1508,7 +2066,7 @@ func runSSH(L *lua.LState, config string, args []string) (error, int) {
 	cmd.Stderr = os.Stderr
 
 	if debugFlag {
-		fmt.Printf("[essh debug] real ssh command: %v \n", cmd.Args)
+		fmt.Printf("[essh debug] real ssh command: %v \n", redact(fmt.Sprint(cmd.Args)))
 	}
 
 	err := cmd.Run()
@@ -1596,6 +2154,15 @@ func validateResources(tasks map[string]*Task, hosts map[string]*Host) error {
 		}
 	}
 
+	// check the backends of the tasks
+	for _, task := range tasks {
+		for _, t := range append([]*Task{task}, task.Steps...) {
+			if !IsBuiltinBackend(t.Backend) && Backends[t.Backend] == nil {
+				return fmt.Errorf("Task '%s' uses undefined backend '%s'.", task.PublicName(), t.Backend)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -1712,6 +2279,8 @@ Options:
   --gen                         Only generate ssh config.
   --working-dir <dir>           Change working directory.
   --config <file>               Load per-project configuration from the file.
+  --profile <name>              Load the overlay config files of the profile like '.esshconfig.<name>.lua'.
+  --offline                     Don't access the network. Use the installed modules and the cached scripts.
   --color                       Force ANSI output.
   --no-color                    Disable ANSI output.
   --debug                       Output debug log.
@@ -1721,10 +2290,18 @@ Options:
   --select <tag|host>           (Using with --hosts option) Get only the hosts filtered with tags or hosts.
   --filter <tag|host>           (Using with --hosts option) Filter selected hosts with tags or hosts.
   --ssh-config                  (Using with --hosts option) Output selected hosts as ssh_config format.
+  --format table|json           (Using with --hosts option) Output format of the hosts.
   --tasks                       List tasks.
   --all                         (Using with --tasks option) Show all that include hidden objects.
   --tags                        List tags.
   --quiet                       (Using with --hosts, --tasks or --tags option) Show only names.
+  --explain <host|task|driver>  Show where the host, task or driver was defined and overridden.
+  --mux-status                  List status of the multiplexed connections.
+  --mux-close                   Close the multiplexed connections.
+
+  (Manage Secrets)
+  --encrypt-secret              Encrypt a secret that is read from stdin for 'essh.secret'.
+  --rotate-secret-key           Generate a new key and re-encrypt the secrets in the loaded config files.
 
   (Manage Modules)
   --update                      Update modules.
@@ -1738,7 +2315,7 @@ Options:
   --exec                        Execute commands with the hosts.
   --target <tag|host>           (Using with --exec option) Target hosts to run the commands.
   --filter <tag|host>           (Using with --exec option) Filter target hosts with tags or hosts.
-  --backend remote|local        (Using with --exec option) Run the commands on local or remote hosts.
+  --backend <backend>           (Using with --exec option) Run the commands on local, remote hosts or by the defined backend.
   --prefix                      (Using with --exec option) Enable outputing prefix.
   --prefix-string <prefix>      (Using with --exec option) Custom string of the prefix.
   --privileged                  (Using with --exec option) Run by the privileged user.
@@ -1747,6 +2324,21 @@ Options:
   --pty                         (Using with --exec option) Allocate pseudo-terminal. (add ssh option "-t -t" internally)
   --script-file                 (Using with --exec option) Load commands from a file.
   --driver                      (Using with --exec option) Specify a driver.
+  --transport ssh|go            Run remote tasks by the ssh command or the built-in ssh client.
+  --yes                         Skip confirmation prompts of tasks.
+  --dry-run                     Show target hosts and policy decisions of a task without running it.
+  --force-unlock                Remove the locks of a task that is specified by the argument.
+  --render                      Print the script of a task that is rendered by the driver.
+  --host <host>                 (Using with --render option) Render the script for the host.
+
+  (History)
+  --history                     List history of task runs.
+  --task <task>                 (Using with --history option) Show only the runs of the task.
+  --host <host>                 (Using with --history option) Show only the runs on the host.
+  --failed                      (Using with --history option) Show only the failed runs.
+  --history-show <id>           Show the details of a task run.
+  --rerun <id|last>             Run the recorded task run again.
+  --retry-failed <id|last>      Run the recorded task run again only on the failed hosts.
 
   (Completion)
   --zsh-completion              Output zsh completion code.
@@ -1854,11 +2446,26 @@ _essh_options() {
         '--clean-all:Clean all data.'
         '--working-dir:Change working directory.'
         '--config:Load per-project configuration from the file.'
+        '--profile:Load the overlay config files of the profile.'
+        '--offline:Do not access the network.'
         '--hosts:List hosts.'
         '--tags:List tags.'
         '--tasks:List tasks.'
+        '--explain:Show where the host, task or driver was defined.'
+        '--mux-status:List status of the multiplexed connections.'
+        '--mux-close:Close the multiplexed connections.'
+        '--encrypt-secret:Encrypt a secret that is read from stdin.'
+        '--rotate-secret-key:Generate a new key and re-encrypt the secrets.'
         '--debug:Output debug log.'
         '--exec:Execute commands with the hosts.'
+        '--yes:Skip confirmation prompts.'
+        '--dry-run:Show target hosts and policy decisions without running.'
+        '--force-unlock:Remove the locks of a task.'
+        '--render:Print the rendered script of a task.'
+        '--history:List history of task runs.'
+        '--history-show:Show the details of a task run.'
+        '--rerun:Run the recorded task run again.'
+        '--retry-failed:Run the recorded task run again only on the failed hosts.'
         '--zsh-completion:Output zsh completion code.'
         '--bash-completion:Output bash completion code.'
         '--aliases:Output aliases code.'
@@ -1874,6 +2481,7 @@ _essh_hosts_options() {
         '--select:Get only the hosts filtered with tags or hosts.'
         '--filter:Filter selected hosts with tags or hosts.'
         '--ssh-config:Output selected hosts as ssh_config format.'
+        '--format:Output format of the hosts.'
      )
     _describe -t option "option" __essh_options
 }
@@ -1912,6 +2520,11 @@ _essh_exec_options() {
         '--pty:Allocate pseudo-terminal. (add ssh option "-t -t" internally)'
         '--script-file:Load commands from a file.'
         '--driver:Specify a driver.'
+        '--transport:Run remote tasks by the ssh command or the built-in ssh client.'
+        '--yes:Skip confirmation prompts.'
+        '--dry-run:Show target hosts and policy decisions without running.'
+        '--force-unlock:Remove the locks of a task.'
+        '--render:Print the rendered script of a task.'
      )
     _describe -t option "option" __essh_options
 }
@@ -2059,6 +2672,7 @@ _essh_hosts_options() {
         --select
         --filter
         --ssh-config
+        --format
     " -- $cur) )
 }
 
@@ -2092,6 +2706,11 @@ _essh_exec_options() {
         '--pty:Allocate pseudo-terminal. (add ssh option "-t -t" internally)'
         '--script-file:Load commands from a file.'
         '--driver:Specify a driver.'
+        '--transport:Run remote tasks by the ssh command or the built-in ssh client.'
+        '--yes:Skip confirmation prompts.'
+        '--dry-run:Show target hosts and policy decisions without running.'
+        '--force-unlock:Remove the locks of a task.'
+        '--render:Print the rendered script of a task.'
      )
     _describe -t option "option" __essh_options
 }
@@ -2110,11 +2729,27 @@ _essh_options() {
         --clean-all
         --working-dir
         --config
+        --profile
+        --offline
         --hosts
         --tags
         --tasks
+        --explain
+        --mux-status
+        --mux-close
+        --encrypt-secret
+        --rotate-secret-key
         --debug
         --exec
+        --transport
+        --yes
+        --dry-run
+        --force-unlock
+        --render
+        --history
+        --history-show
+        --rerun
+        --retry-failed
         --zsh-completion
         --bash-completion
         --aliases
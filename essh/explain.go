@@ -0,0 +1,212 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"sort"
+	"strings"
+)
+
+// explainLayer is a definition of a host, task or driver in the layered structure.
+type explainLayer struct {
+	Source   string
+	Registry *Registry
+	Module   *Module
+	Group    *Group
+	LValues  map[string]lua.LValue
+}
+
+// definitionSource returns a position of the lua code that calls the resource's function like 'host'.
+func definitionSource(L *lua.LState) string {
+	return strings.TrimSuffix(L.Where(1), ":")
+}
+
+func hostLayers(h *Host) []*explainLayer {
+	// the definition that was defined first is the bottom.
+	for h.Child != nil {
+		h = h.Child
+	}
+
+	layers := []*explainLayer{}
+	for ; h != nil; h = h.Parent {
+		layers = append(layers, &explainLayer{Source: h.Source, Registry: h.Registry, Module: h.Module, Group: h.Group, LValues: h.LValues})
+	}
+
+	return layers
+}
+
+func taskLayers(t *Task) []*explainLayer {
+	for t.Child != nil {
+		t = t.Child
+	}
+
+	layers := []*explainLayer{}
+	for ; t != nil; t = t.Parent {
+		layers = append(layers, &explainLayer{Source: t.Source, Registry: t.Registry, Module: t.Module, Group: t.Group, LValues: t.LValues})
+	}
+
+	return layers
+}
+
+func driverLayers(d *Driver) []*explainLayer {
+	for d.Child != nil {
+		d = d.Child
+	}
+
+	layers := []*explainLayer{}
+	for ; d != nil; d = d.Parent {
+		layers = append(layers, &explainLayer{Source: d.Source, Registry: d.Registry, Module: d.Module, Group: d.Group, LValues: d.LValues})
+	}
+
+	return layers
+}
+
+// explain prints the definitions of the hosts, tasks and drivers that have the name.
+func explain(name string) error {
+	found := false
+
+	if h := Hosts[name]; h != nil {
+		printExplain("host", name, hostLayers(h))
+		found = true
+	}
+
+	if t := Tasks[name]; t != nil {
+		if found {
+			fmt.Println()
+		}
+		printExplain("task", name, taskLayers(t))
+		found = true
+	}
+
+	if d := Drivers[name]; d != nil {
+		if found {
+			fmt.Println()
+		}
+		printExplain("driver", name, driverLayers(d))
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("host, task or driver '%s' is not found.", name)
+	}
+
+	return nil
+}
+
+func printExplain(kind string, name string, layers []*explainLayer) {
+	fmt.Printf("%s: %s\n", kind, name)
+
+	for i, layer := range layers {
+		source := layer.Source
+		if source == "" {
+			source = "(built-in)"
+		}
+		fmt.Printf("\n[%d] %s\n", i+1, source)
+		fmt.Printf("    registry: %s\n", registryTypeName(layer.Registry))
+		if layer.Module != nil {
+			fmt.Printf("    module: %s\n", layer.Module.Name)
+		}
+		if layer.Group != nil {
+			fmt.Printf("    group: %s\n", strings.Join(groupKeys(layer.Group), ", "))
+		}
+
+		keys := sortedLValueKeys(layer.LValues)
+		if len(keys) > 0 {
+			fmt.Printf("    set: %s\n", strings.Join(keys, ", "))
+		}
+
+		if i > 0 {
+			// the definition replaces the previous one.
+			prev := layers[i-1].LValues
+			overrode := []string{}
+			for _, key := range keys {
+				if _, ok := prev[key]; ok {
+					overrode = append(overrode, key)
+				}
+			}
+			dropped := []string{}
+			for _, key := range sortedLValueKeys(prev) {
+				if _, ok := layer.LValues[key]; !ok {
+					dropped = append(dropped, key)
+				}
+			}
+
+			if len(overrode) > 0 {
+				fmt.Printf("    overrode: %s\n", strings.Join(overrode, ", "))
+			}
+			if len(dropped) > 0 {
+				fmt.Printf("    dropped: %s\n", strings.Join(dropped, ", "))
+			}
+		}
+	}
+
+	fmt.Printf("\neffective:\n")
+	effective := layers[len(layers)-1].LValues
+	sensitive := []string{}
+	if lv, ok := effective["sensitive"]; ok {
+		sensitive, _ = toSensitive(lv)
+	}
+	for _, key := range sortedLValueKeys(effective) {
+		fmt.Printf("    %s = %s\n", key, explainValue(key, effective[key], sensitive))
+	}
+}
+
+func registryTypeName(reg *Registry) string {
+	if reg == nil {
+		return "-"
+	}
+	if reg.Type == RegistryTypeGlobal {
+		return "global"
+	}
+
+	return "local"
+}
+
+func groupKeys(group *Group) []string {
+	keys := []string{}
+	for _, key := range sortedLValueKeys(group.LValues) {
+		if key != "hosts" && key != "tasks" && key != "drivers" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return []string{"(no fields)"}
+	}
+
+	return keys
+}
+
+func sortedLValueKeys(lvalues map[string]lua.LValue) []string {
+	keys := []string{}
+	for key := range lvalues {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// explainValue returns a string of the field's value. The sensitive values of the props and env are redacted.
+func explainValue(key string, lv lua.LValue, sensitive []string) string {
+	switch v := lv.(type) {
+	case *lua.LFunction:
+		return "(function)"
+	case *lua.LUserData:
+		if secret, ok := v.Value.(*Secret); ok {
+			return secret.String()
+		}
+		return "(userdata)"
+	case lua.LString:
+		return fmt.Sprintf("%q", lv.String())
+	}
+
+	if isPropValue(lv) {
+		value := toGoValue(lv)
+		if m, ok := value.(map[string]interface{}); ok && (key == "props" || key == "env") {
+			value = redactProps(m, sensitive)
+		}
+		return PropString(value)
+	}
+
+	return lv.String()
+}
@@ -0,0 +1,604 @@
+package essh
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/helper"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HISTORY_OUTCOME_DENIED    = "denied"
+	HISTORY_OUTCOME_CANCELLED = "cancelled"
+	HISTORY_OUTCOME_LOCKED    = "locked"
+)
+
+// DefaultHistoryRetention is days to keep history records.
+// It can be changed by 'essh.history_retention'. 0 keeps records forever.
+var DefaultHistoryRetention = 90
+
+// HistoryRecord is a record of a task run.
+type HistoryRecord struct {
+	ID         string           `json:"id"`
+	Timestamp  time.Time        `json:"timestamp"`
+	User       string           `json:"user"`
+	WorkingDir string           `json:"working_dir"`
+	Task       string           `json:"task"`
+	Profile    string           `json:"profile,omitempty"`
+	Args       []string         `json:"args"`
+	Command    []string         `json:"command"`
+	Hosts      []string         `json:"hosts"`
+	Results    []*HistoryResult `json:"results"`
+	Duration   float64          `json:"duration"`
+	Failed     bool             `json:"failed"`
+	Error      string           `json:"error,omitempty"`
+	// Outcome is a reason why the task didn't run like "denied", "cancelled" or "locked".
+	Outcome string `json:"outcome,omitempty"`
+	// ParentID is an id of the record that this run repeats by --rerun or --retry-failed.
+	ParentID string `json:"parent_id,omitempty"`
+	// RetryHosts is hosts that this run was restricted to by --retry-failed.
+	RetryHosts []string `json:"retry_hosts,omitempty"`
+	m          sync.Mutex
+}
+
+// HistoryResult is a result of running a task on a host.
+type HistoryResult struct {
+	Host       string  `json:"host"`
+	Step       string  `json:"step,omitempty"`
+	ExitCode   int     `json:"exit_code"`
+	Duration   float64 `json:"duration"`
+	ScriptHash string  `json:"script_hash,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+func NewHistoryRecord(task *Task, args []string, hosts []*Host) *HistoryRecord {
+	now := time.Now()
+	record := &HistoryRecord{
+		ID:         fmt.Sprintf("%s-%d", now.Format("20060102150405"), os.Getpid()),
+		Timestamp:  now,
+		User:       currentUsername(),
+		WorkingDir: commandDir,
+		Task:       task.Name,
+		Profile:    profileVar,
+		Args:       redactArgs(args, task.Sensitive, task.SensitiveArgs),
+		Command:    redactArgs(commandArgs, task.Sensitive, false),
+		Hosts:      []string{},
+		Results:    []*HistoryResult{},
+		ParentID:   historyParentID,
+		RetryHosts: []string{},
+	}
+
+	for name := range retryHosts {
+		record.RetryHosts = append(record.RetryHosts, name)
+	}
+	sort.Strings(record.RetryHosts)
+
+	record.SetHosts(hosts)
+
+	return record
+}
+
+// SetHosts sets the target hosts of the run.
+func (r *HistoryRecord) SetHosts(hosts []*Host) {
+	r.Hosts = []string{}
+	for _, host := range hosts {
+		r.Hosts = append(r.Hosts, host.Name)
+	}
+}
+
+func (r *HistoryRecord) result(task *Task, host *Host) *HistoryResult {
+	hostName := ""
+	if host != nil {
+		hostName = host.Name
+	}
+
+	for _, result := range r.Results {
+		if result.Host == hostName && result.Step == task.StepName {
+			return result
+		}
+	}
+
+	result := &HistoryResult{
+		Host: hostName,
+		Step: task.StepName,
+	}
+	r.Results = append(r.Results, result)
+
+	return result
+}
+
+// SetScriptHash records a hash of the script that is rendered for the host.
+func (r *HistoryRecord) SetScriptHash(task *Task, host *Host, script string) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.result(task, host).ScriptHash = fmt.Sprintf("%x", sha256.Sum256([]byte(script)))
+}
+
+// AddResult records the result of running the task on the host.
+func (r *HistoryRecord) AddResult(task *Task, host *Host, duration time.Duration, err error) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	result := r.result(task, host)
+	result.Duration = duration.Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		result.ExitCode = -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.ExitCode()
+		} else if exitErr, ok := err.(interface {
+			ExitStatus() int
+		}); ok {
+			// an error of the built-in ssh client.
+			result.ExitCode = exitErr.ExitStatus()
+		}
+	}
+}
+
+func (r *HistoryRecord) Finish(err error) {
+	r.Duration = time.Since(r.Timestamp).Seconds()
+	if err != nil {
+		r.Failed = true
+		r.Error = err.Error()
+	}
+}
+
+func (r *HistoryRecord) HasHost(name string) bool {
+	for _, h := range r.Hosts {
+		if h == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// FailedHosts returns the hosts that failed or did not finish in the run.
+func (r *HistoryRecord) FailedHosts() []string {
+	finished := map[string]bool{}
+	failed := map[string]bool{}
+	for _, result := range r.Results {
+		if result.Error != "" {
+			failed[result.Host] = true
+		} else {
+			finished[result.Host] = true
+		}
+	}
+
+	hosts := []string{}
+	for _, h := range r.Hosts {
+		if failed[h] || !finished[h] {
+			hosts = append(hosts, h)
+		}
+	}
+
+	return hosts
+}
+
+func (r *HistoryRecord) Status() string {
+	if r.Outcome != "" {
+		return r.Outcome
+	}
+
+	if r.Failed {
+		return "failed"
+	}
+
+	return "success"
+}
+
+func (reg *Registry) HistoryDir() string {
+	return filepath.Join(reg.DataDir, "history")
+}
+
+// historyRegistry returns the registry that stores history records.
+// History is stored per user, so that it can be seen from any directories.
+func historyRegistry() *Registry {
+	if GlobalRegistry != nil {
+		return GlobalRegistry
+	}
+
+	return NewRegistry(UserDataDir, RegistryTypeGlobal)
+}
+
+func historyRetention(L *lua.LState) (int, error) {
+	lessh, ok := toLTable(L.GetGlobal("essh"))
+	if !ok {
+		return 0, fmt.Errorf("essh must be a table")
+	}
+
+	v := lessh.RawGetString("history_retention")
+	if v == lua.LNil {
+		return DefaultHistoryRetention, nil
+	}
+
+	days, ok := toFloat64(v)
+	if !ok {
+		return 0, fmt.Errorf("invalid value %v in the 'history_retention'", v)
+	}
+
+	return int(days), nil
+}
+
+// SaveHistoryRecord writes the record and removes the records older than the retention.
+func SaveHistoryRecord(L *lua.LState, record *HistoryRecord) error {
+	record.m.Lock()
+	err := writeHistoryRecord(record)
+	record.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	dir := historyRegistry().HistoryDir()
+	retention, err := historyRetention(L)
+	if err != nil {
+		return err
+	}
+
+	if retention <= 0 {
+		return nil
+	}
+
+	records, err := LoadHistoryRecords()
+	if err != nil {
+		return err
+	}
+
+	expiration := time.Now().AddDate(0, 0, -retention)
+	for _, r := range records {
+		if r.Timestamp.Before(expiration) {
+			if err := os.Remove(filepath.Join(dir, r.ID+".json")); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeHistoryRecord writes the record to the history directory.
+// The records are readable only by the user, because they have the args.
+func writeHistoryRecord(record *HistoryRecord) error {
+	dir := historyRegistry().HistoryDir()
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	// the errors may have the sensitive values in the commands.
+	record.Error = redact(record.Error)
+	for _, result := range record.Results {
+		result.Error = redact(result.Error)
+	}
+
+	b, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, record.ID+".json"), b, 0600); err != nil {
+		return err
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] saved history record: %s\n", record.ID)
+	}
+
+	return nil
+}
+
+// Abort finishes the record by the error and saves it.
+// It is used when the parallel run aborts at the first failure without returning to runTask.
+func (r *HistoryRecord) Abort(err error) {
+	if r == nil {
+		return
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.Finish(err)
+	if herr := writeHistoryRecord(r); herr != nil {
+		printError(fmt.Errorf("failed to save the history: %v", herr))
+	}
+}
+
+// LoadHistoryRecords returns all the history records. The newest record is first.
+func LoadHistoryRecords() ([]*HistoryRecord, error) {
+	dir := historyRegistry().HistoryDir()
+	records := []*HistoryRecord{}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return records, nil
+		}
+		return nil, err
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+
+		record, err := LoadHistoryRecord(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Timestamp.After(records[j].Timestamp)
+	})
+
+	return records, nil
+}
+
+func LoadHistoryRecord(id string) (*HistoryRecord, error) {
+	if id == "last" {
+		records, err := LoadHistoryRecords()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("there is no history.")
+		}
+		return records[0], nil
+	}
+
+	if id == "" || strings.ContainsAny(id, `/\`) {
+		return nil, fmt.Errorf("invalid history id '%s'.", id)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(historyRegistry().HistoryDir(), id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("history '%s' is not found.", id)
+		}
+		return nil, err
+	}
+
+	record := &HistoryRecord{}
+	if err := json.Unmarshal(b, record); err != nil {
+		return nil, fmt.Errorf("history '%s' is broken: %v", id, err)
+	}
+
+	return record, nil
+}
+
+// argumentOptions are the options that take the next argument as their value.
+var argumentOptions = []string{
+	"--select",
+	"--format",
+	"--working-dir",
+	"--config",
+	"--profile",
+	"--user",
+	"--prefix-string",
+	"--driver",
+	"--target",
+	"--filter",
+	"--backend",
+	"--history-show",
+	"--task",
+	"--host",
+	"--transport",
+	"--explain",
+}
+
+func optionHasArgument(arg string) bool {
+	for _, o := range argumentOptions {
+		if arg == o {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveRerunArgs replaces the arguments with the ones of the history record,
+// if --rerun or --retry-failed option is specified.
+// The other essh options are kept and prepended to the recorded arguments.
+func resolveRerunArgs(osArgs []string) ([]string, error) {
+	rest := []string{}
+	id := ""
+	retry := false
+
+	for i := 0; i < len(osArgs); i++ {
+		arg := osArgs[i]
+		if arg == "--" {
+			rest = append(rest, osArgs[i:]...)
+			break
+		} else if arg == "--rerun" || arg == "--retry-failed" {
+			if i+1 >= len(osArgs) {
+				return nil, fmt.Errorf("%s reguires an argument.", arg)
+			}
+			id = osArgs[i+1]
+			retry = arg == "--retry-failed"
+			i++
+		} else if strings.HasPrefix(arg, "--rerun=") {
+			id = strings.Split(arg, "=")[1]
+		} else if strings.HasPrefix(arg, "--retry-failed=") {
+			id = strings.Split(arg, "=")[1]
+			retry = true
+		} else if !strings.HasPrefix(arg, "--") {
+			// the options are parsed until the first non-option argument like a task name.
+			// the arguments after it are the task's arguments, even if they look like '--rerun'.
+			rest = append(rest, osArgs[i:]...)
+			break
+		} else {
+			rest = append(rest, arg)
+			if optionHasArgument(arg) && i+1 < len(osArgs) {
+				// the option's argument isn't a non-option argument.
+				rest = append(rest, osArgs[i+1])
+				i++
+			}
+		}
+	}
+
+	if id == "" {
+		return osArgs, nil
+	}
+
+	record, err := LoadHistoryRecord(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, arg := range record.Command {
+		if strings.Contains(arg, RedactMask) {
+			return nil, fmt.Errorf("the history '%s' can't be rerun because the arguments are redacted.", record.ID)
+		}
+	}
+
+	hosts := record.RetryHosts
+	if retry {
+		hosts = record.FailedHosts()
+		if len(hosts) == 0 {
+			return nil, fmt.Errorf("there are no failed hosts in the history '%s'.", record.ID)
+		}
+	}
+
+	if len(hosts) > 0 {
+		retryHosts = map[string]bool{}
+		for _, h := range hosts {
+			if h != "" {
+				retryHosts[h] = true
+			}
+		}
+		if len(retryHosts) == 0 {
+			// only the local run failed. it runs again without restriction.
+			retryHosts = nil
+		}
+	}
+
+	if err := os.Chdir(record.WorkingDir); err != nil {
+		return nil, err
+	}
+	if record.Profile != "" {
+		// the profile may be given by ESSH_PROFILE. it runs with the recorded profile.
+		rest = append(rest, "--profile="+record.Profile)
+	}
+	commandDir = record.WorkingDir
+	historyParentID = record.ID
+
+	if debugFlag {
+		fmt.Printf("[essh debug] rerun the history '%s' in %s: %v\n", record.ID, record.WorkingDir, record.Command)
+	}
+
+	return append(rest, record.Command...), nil
+}
+
+// restrictRetryHosts returns only the hosts that are retried by --retry-failed.
+func restrictRetryHosts(hosts []*Host) []*Host {
+	if retryHosts == nil {
+		return hosts
+	}
+
+	restricted := []*Host{}
+	for _, host := range hosts {
+		if retryHosts[host.Name] {
+			restricted = append(restricted, host)
+		}
+	}
+
+	return restricted
+}
+
+func printHistory(taskName string, hostName string, failedOnly bool) error {
+	records, err := LoadHistoryRecords()
+	if err != nil {
+		return err
+	}
+
+	tb := helper.NewPlainTable(os.Stdout)
+	if !quietFlag {
+		tb.SetHeader([]string{"ID", "TIME", "USER", "TASK", "PROFILE", "HOSTS", "STATUS"})
+	}
+
+	for _, r := range records {
+		if taskName != "" && r.Task != taskName {
+			continue
+		}
+		if hostName != "" && !r.HasHost(hostName) {
+			continue
+		}
+		if failedOnly && !r.Failed {
+			continue
+		}
+
+		if quietFlag {
+			tb.Append([]string{r.ID})
+		} else {
+			tb.Append([]string{r.ID, r.Timestamp.Format("2006-01-02 15:04:05"), r.User, r.Task, r.Profile, fmt.Sprintf("%d", len(r.Hosts)), r.Status()})
+		}
+	}
+	tb.Render()
+
+	return nil
+}
+
+func printHistoryRecord(id string) error {
+	r, err := LoadHistoryRecord(id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("id:          %s\n", r.ID)
+	fmt.Printf("time:        %s\n", r.Timestamp.Format(time.RFC3339))
+	fmt.Printf("user:        %s\n", r.User)
+	fmt.Printf("working dir: %s\n", r.WorkingDir)
+	fmt.Printf("task:        %s\n", r.Task)
+	if r.Profile != "" {
+		fmt.Printf("profile:     %s\n", r.Profile)
+	}
+	fmt.Printf("args:        %s\n", strings.Join(r.Args, " "))
+	fmt.Printf("command:     essh %s\n", strings.Join(r.Command, " "))
+	fmt.Printf("hosts:       %s\n", strings.Join(r.Hosts, ", "))
+	fmt.Printf("duration:    %.3fs\n", r.Duration)
+	fmt.Printf("status:      %s\n", r.Status())
+	if r.ParentID != "" {
+		fmt.Printf("parent:      %s\n", r.ParentID)
+	}
+	if len(r.RetryHosts) > 0 {
+		fmt.Printf("retry hosts: %s\n", strings.Join(r.RetryHosts, ", "))
+	}
+	if r.Error != "" {
+		fmt.Printf("error:       %s\n", r.Error)
+	}
+	fmt.Println()
+
+	tb := helper.NewPlainTable(os.Stdout)
+	tb.SetHeader([]string{"HOST", "STEP", "EXIT", "DURATION", "SCRIPT HASH"})
+	for _, result := range r.Results {
+		host := result.Host
+		if host == "" {
+			host = "(local)"
+		}
+		hash := result.ScriptHash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		tb.Append([]string{host, result.Step, fmt.Sprintf("%d", result.ExitCode), fmt.Sprintf("%.3fs", result.Duration), hash})
+	}
+	tb.Render()
+
+	return nil
+}
@@ -2,6 +2,7 @@ package essh
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/yuin/gopher-lua"
 	"sort"
@@ -13,26 +14,31 @@ import (
 type Host struct {
 	Name                 string
 	Description          string
-	Props                map[string]string
+	Props                map[string]interface{}
 	HooksBeforeConnect   []interface{}
 	HooksAfterConnect    []interface{}
 	HooksAfterDisconnect []interface{}
 	Hidden               bool
 	Tags                 []string
 	SSHConfig            map[string]string
+	Multiplex            bool
+	Sensitive            []string
 	Registry             *Registry
 	Group                *Group
+	Module               *Module
 	LValues              map[string]lua.LValue
 	// If you define same name hosts in multi time, stores it in layered structure that uses Parent and Child.
 	Parent *Host
 	Child  *Host
+	// Source is a position of the lua code that defines the host.
+	Source string
 }
 
 var Hosts map[string]*Host
 
 func NewHost() *Host {
 	return &Host{
-		Props:                map[string]string{},
+		Props:                map[string]interface{}{},
 		HooksBeforeConnect:   []interface{}{},
 		HooksAfterConnect:    []interface{}{},
 		HooksAfterDisconnect: []interface{}{},
@@ -68,6 +74,32 @@ func (h *Host) SortedSSHConfig() []map[string]string {
 	return values
 }
 
+// SSHConfigValue returns the value of the ssh config. The keyword is case-insensitive like ssh_config.
+func (h *Host) SSHConfigValue(key string) string {
+	if v, ok := h.SSHConfig[key]; ok {
+		return v
+	}
+
+	for k, v := range h.SSHConfig {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// SetSSHConfigValue sets the value of the ssh config. It replaces the keyword that differs only in case.
+func (h *Host) SetSSHConfigValue(key string, value string) {
+	for k := range h.SSHConfig {
+		if strings.EqualFold(k, key) {
+			delete(h.SSHConfig, k)
+		}
+	}
+
+	h.SSHConfig[key] = value
+}
+
 func (h *Host) DescriptionOrDefault() string {
 	if h.Description == "" {
 		return h.Name + " host"
@@ -77,12 +109,16 @@ func (h *Host) DescriptionOrDefault() string {
 }
 
 var hostsTemplate = `{{range $i, $host := .Hosts -}}
-Host {{$host.Name}}{{range $ii, $param := $host.SortedSSHConfig}}{{range $k, $v := $param}}
+Host {{$host.Name}}{{range $ii, $param := $host.GeneratedSSHConfig}}{{range $k, $v := $param}}
     {{$k}} {{$v}}{{end}}{{end}}
 
 {{end -}}`
 
 func GenHostsConfig(enabledHosts []*Host) ([]byte, error) {
+	if err := mkMuxDirs(enabledHosts); err != nil {
+		return nil, err
+	}
+
 	tmpl, err := template.New("T").Parse(hostsTemplate)
 	if err != nil {
 		return nil, err
@@ -185,6 +221,7 @@ func registerHost(L *lua.LState, name string) *Host {
 	h := NewHost()
 	h.Name = name
 	h.Registry = CurrentRegistry
+	h.Source = definitionSource(L)
 
 	if host := Hosts[h.Name]; host != nil {
 		// detect same name host
@@ -193,6 +230,7 @@ func registerHost(L *lua.LState, name string) *Host {
 	}
 
 	if EvaluatingModule != nil {
+		h.Module = EvaluatingModule
 		EvaluatingModule.Hosts = append(EvaluatingModule.Hosts, h)
 	}
 
@@ -230,21 +268,7 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 	switch key {
 	case "props":
 		if propsTb, ok := toLTable(value); ok {
-			// initialize
-			h.Props = map[string]string{}
-
-			propsTb.ForEach(func(propsKey lua.LValue, propsValue lua.LValue) {
-				propsKeyStr, ok := toString(propsKey)
-				if !ok {
-					L.RaiseError("props table's key must be a string: %v", propsKey)
-				}
-				propsValueStr, ok := toString(propsValue)
-				if !ok {
-					L.RaiseError("props table's value must be a string: %v", propsValue)
-				}
-
-				h.Props[propsKeyStr] = propsValueStr
-			})
+			h.Props = toProps(L, propsTb)
 		} else {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
@@ -298,6 +322,13 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
 
+	case "multiplex":
+		if multiplexBool, ok := toBool(value); ok {
+			h.Multiplex = multiplexBool
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
 	case "tags":
 		if tagsTb, ok := toLTable(value); ok {
 			// initialize
@@ -314,6 +345,13 @@ func updateHost(L *lua.LState, h *Host, key string, value lua.LValue) {
 			panic("invalid value of a host's field '" + key + "'.")
 		}
 
+	case "sensitive":
+		if sensitive, ok := toSensitive(value); ok {
+			h.Sensitive = sensitive
+		} else {
+			panic("invalid value of a host's field '" + key + "'.")
+		}
+
 	default:
 		panic("unsupported host's field '" + key + "'.")
 
@@ -385,3 +423,35 @@ func hostNewindex(L *lua.LState) int {
 
 	return 0
 }
+
+// hostJSON is a host that is output by '--hosts --format json'.
+type hostJSON struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Tags        []string               `json:"tags"`
+	Hidden      bool                   `json:"hidden"`
+	Props       map[string]interface{} `json:"props"`
+	SSHConfig   map[string]string      `json:"ssh_config"`
+}
+
+func printHostsJSON(hosts []*Host) error {
+	values := []*hostJSON{}
+	for _, h := range hosts {
+		values = append(values, &hostJSON{
+			Name:        h.Name,
+			Description: h.Description,
+			Tags:        h.Tags,
+			Hidden:      h.Hidden,
+			Props:       redactProps(h.Props, h.Sensitive),
+			SSHConfig:   h.SSHConfig,
+		})
+	}
+
+	b, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+
+	return nil
+}
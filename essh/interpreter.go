@@ -0,0 +1,157 @@
+package essh
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Interpreter is a program that runs the scripts generated by drivers.
+type Interpreter struct {
+	Name string
+	// Command is a command line to run a script that is passed as a last argument.
+	Command string
+	// LoginCommand is a command line that is used with sudo.
+	LoginCommand string
+	// FileFlag is an option to run a script file instead of the code. (e.g. "-File")
+	FileFlag string
+	// FileExt is an extension that the interpreter requires to run a script file.
+	FileExt string
+	// Shell is true if the interpreter understands shell commands like 'cd'.
+	Shell bool
+	// Preamble is a code that is placed before the environment variables.
+	Preamble string
+	// Export returns a code that sets the environment variable.
+	Export func(key, value string) string
+}
+
+var DefaultInterpreterName = "bash"
+
+var Interpreters = map[string]*Interpreter{
+	"bash": {
+		Name:         "bash",
+		Command:      "bash -c",
+		LoginCommand: "bash -l -c",
+		Shell:        true,
+		Export: func(key, value string) string {
+			return "export " + key + "=" + ShellEscape(value)
+		},
+	},
+	"sh": {
+		Name:         "sh",
+		Command:      "sh -c",
+		LoginCommand: "sh -c",
+		Shell:        true,
+		Export: func(key, value string) string {
+			return "export " + key + "=" + ShellEscape(value)
+		},
+	},
+	"python": {
+		Name:         "python",
+		Command:      "python3 -c",
+		LoginCommand: "python3 -c",
+		Preamble:     "import os as __essh_os",
+		Export: func(key, value string) string {
+			return "__essh_os.environ[" + PythonEscape(key) + "] = " + PythonEscape(value)
+		},
+	},
+	"perl": {
+		Name:         "perl",
+		Command:      "perl -e",
+		LoginCommand: "perl -e",
+		Export: func(key, value string) string {
+			return "$ENV{" + PerlEscape(key) + "} = " + PerlEscape(value) + ";"
+		},
+	},
+	"pwsh": {
+		Name:         "pwsh",
+		Command:      "pwsh -NoProfile -NonInteractive -Command",
+		LoginCommand: "pwsh -NonInteractive -Command",
+		FileFlag:     "-File",
+		FileExt:      ".ps1",
+		Export: func(key, value string) string {
+			return "[Environment]::SetEnvironmentVariable(" + PowerShellEscape(key) + ", " + PowerShellEscape(value) + ")"
+		},
+	},
+}
+
+// InterpreterNames returns sorted names of the built-in interpreters.
+func InterpreterNames() []string {
+	names := []string{}
+	for name := range Interpreters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+var shellInterpreterRegexp = regexp.MustCompile(`^(python|perl)[0-9.]*$`)
+
+// ShellInterpreter returns the interpreter that has the syntax of the task's shell like "/usr/bin/env python3".
+// The other shells are treated as sh-compatible.
+func ShellInterpreter(shell string) *Interpreter {
+	fields := strings.Fields(shell)
+	if len(fields) == 0 {
+		return Interpreters["sh"]
+	}
+
+	command := filepath.Base(fields[0])
+	if command == "env" && len(fields) >= 2 {
+		command = filepath.Base(fields[1])
+	}
+
+	if m := shellInterpreterRegexp.FindStringSubmatch(command); m != nil {
+		return Interpreters[m[1]]
+	}
+	if command == "pwsh" || command == "powershell" {
+		return Interpreters["pwsh"]
+	}
+
+	return Interpreters["sh"]
+}
+
+// InterpreterName returns the interpreter of the driver. It inherits the parent's interpreter.
+func (driver *Driver) InterpreterName() string {
+	visited := map[*Driver]bool{}
+	for d := driver; d != nil && !visited[d]; {
+		visited[d] = true
+		if d.Interpreter != "" {
+			return d.Interpreter
+		}
+
+		parent, err := d.ParentDriver()
+		if err != nil {
+			break
+		}
+		d = parent
+	}
+
+	return DefaultInterpreterName
+}
+
+// Interpreter returns the interpreter that runs the task's script.
+// If the task has the shell, it returns the interpreter that has the syntax of the shell.
+func (t *Task) Interpreter() (*Interpreter, error) {
+	if t.Shell != "" {
+		return ShellInterpreter(t.Shell), nil
+	}
+
+	name := DefaultInterpreterName
+	driverName := t.Driver
+	if driverName == "" {
+		driverName = DefaultDriverName
+	}
+	if driver := Drivers[driverName]; driver != nil {
+		name = driver.InterpreterName()
+	}
+
+	interpreter := Interpreters[name]
+	if interpreter == nil {
+		return nil, fmt.Errorf("invalid interpreter '%s'", name)
+	}
+
+	return interpreter, nil
+}
@@ -0,0 +1,378 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// InventoryDirName is a directory in the data directory that has the YAML and JSON files defining hosts and tasks.
+var InventoryDirName = "inventory"
+
+// InventoryFileExts are extensions of the inventory files. JSON files are parsed as YAML.
+var InventoryFileExts = []string{".yaml", ".yml", ".json"}
+
+// inventoryDir returns the inventory directory of the data directory like "~/.essh".
+func inventoryDir(dataDir string) string {
+	return filepath.Join(dataDir, InventoryDirName)
+}
+
+// hasInventoryDir returns true if the data directory has the inventory directory.
+func hasInventoryDir(dataDir string) bool {
+	fi, err := os.Stat(inventoryDir(dataDir))
+	return err == nil && fi.IsDir()
+}
+
+// inventoryFiles returns the inventory files in lexical order.
+func inventoryFiles(dataDir string) ([]string, error) {
+	files := []string{}
+	for _, ext := range InventoryFileExts {
+		matches, err := filepath.Glob(filepath.Join(inventoryDir(dataDir), "*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// loadInventory loads all the inventory files in the inventory directory of the data directory.
+func loadInventory(L *lua.LState, dataDir string) error {
+	files, err := inventoryFiles(dataDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := loadInventoryFile(L, file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadInventoryFile registers the hosts and tasks that are defined in the inventory file.
+// The top level keys are "hosts", "tasks" and "groups", and the fields are the same as the ones of the lua config.
+func loadInventoryFile(L *lua.LState, file string) error {
+	if debugFlag {
+		fmt.Printf("[essh debug] loading inventory file: %s\n", file)
+	}
+
+	loadedConfigFiles = append(loadedConfigFiles, file)
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(b, doc); err != nil {
+		return fmt.Errorf("%s: %s", file, strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+
+	if len(doc.Content) > 0 {
+		inv := &inventoryLoader{L: L, file: file}
+		if err := inv.load(doc.Content[0]); err != nil {
+			return err
+		}
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] loaded inventory file: %s\n", file)
+	}
+
+	return nil
+}
+
+type inventoryLoader struct {
+	L    *lua.LState
+	file string
+}
+
+func (inv *inventoryLoader) errorf(node *yaml.Node, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d:%d: %s", inv.file, node.Line, node.Column, fmt.Sprintf(format, args...))
+}
+
+// mapping calls the fn with the keys and values of the mapping node. It doesn't allow duplicated keys.
+func (inv *inventoryLoader) mapping(node *yaml.Node, what string, fn func(key string, keyNode *yaml.Node, valueNode *yaml.Node) error) error {
+	node = resolveAlias(node)
+	if node.Kind != yaml.MappingNode {
+		return inv.errorf(node, "expected mapping of %s but got '%s'", what, node.Value)
+	}
+
+	lines := map[string]int{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode := node.Content[i]
+		valueNode := node.Content[i+1]
+		if keyNode.ShortTag() == "!!merge" {
+			return inv.errorf(keyNode, "merge keys are not supported")
+		}
+		if keyNode.Kind != yaml.ScalarNode {
+			return inv.errorf(keyNode, "expected string key of %s", what)
+		}
+
+		key := keyNode.Value
+		if line, ok := lines[key]; ok {
+			return inv.errorf(keyNode, "duplicated key '%s' (defined at line %d)", key, line)
+		}
+		lines[key] = keyNode.Line
+
+		if err := fn(key, keyNode, valueNode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (inv *inventoryLoader) load(root *yaml.Node) error {
+	return inv.mapping(root, "inventory", func(key string, keyNode *yaml.Node, valueNode *yaml.Node) error {
+		switch key {
+		case "hosts":
+			_, err := inv.loadHosts(valueNode)
+			return err
+		case "tasks":
+			_, err := inv.loadTasks(valueNode)
+			return err
+		case "groups":
+			valueNode = resolveAlias(valueNode)
+			if valueNode.Kind != yaml.SequenceNode {
+				return inv.errorf(valueNode, "expected sequence of groups")
+			}
+			for _, groupNode := range valueNode.Content {
+				if err := inv.loadGroup(groupNode); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		return inv.errorf(keyNode, "unsupported inventory's key '%s'. it must be 'hosts', 'tasks' or 'groups'.", key)
+	})
+}
+
+func (inv *inventoryLoader) loadHosts(node *yaml.Node) ([]*Host, error) {
+	hosts := []*Host{}
+
+	err := inv.mapping(node, "hosts", func(name string, nameNode *yaml.Node, configNode *yaml.Node) error {
+		h := registerHost(inv.L, name)
+		h.Source = fmt.Sprintf("%s:%d", inv.file, nameNode.Line)
+		hosts = append(hosts, h)
+
+		return inv.mapping(configNode, "host's config", func(key string, keyNode *yaml.Node, valueNode *yaml.Node) error {
+			return inv.update(keyNode, valueNode, func(L *lua.LState, value lua.LValue) {
+				updateHost(L, h, key, value)
+			})
+		})
+	})
+
+	return hosts, err
+}
+
+func (inv *inventoryLoader) loadTasks(node *yaml.Node) ([]*Task, error) {
+	tasks := []*Task{}
+
+	err := inv.mapping(node, "tasks", func(name string, nameNode *yaml.Node, configNode *yaml.Node) error {
+		t := registerTask(inv.L, name)
+		t.Source = fmt.Sprintf("%s:%d", inv.file, nameNode.Line)
+		tasks = append(tasks, t)
+
+		return inv.mapping(configNode, "task's config", func(key string, keyNode *yaml.Node, valueNode *yaml.Node) error {
+			return inv.update(keyNode, valueNode, func(L *lua.LState, value lua.LValue) {
+				updateTask(L, t, key, value)
+			})
+		})
+	})
+
+	return tasks, err
+}
+
+func (inv *inventoryLoader) loadGroup(node *yaml.Node) error {
+	group := NewGroup()
+	hosts := []*Host{}
+	tasks := []*Task{}
+	defaults := [][2]*yaml.Node{}
+
+	err := inv.mapping(node, "group", func(key string, keyNode *yaml.Node, valueNode *yaml.Node) error {
+		var err error
+		switch key {
+		case "hosts":
+			if len(tasks) > 0 {
+				return inv.errorf(keyNode, "group can use only one type of resources.")
+			}
+			hosts, err = inv.loadHosts(valueNode)
+		case "tasks":
+			if len(hosts) > 0 {
+				return inv.errorf(keyNode, "group can use only one type of resources.")
+			}
+			tasks, err = inv.loadTasks(valueNode)
+		case "drivers":
+			err = inv.errorf(keyNode, "inventory files don't support drivers.")
+		default:
+			defaults = append(defaults, [2]*yaml.Node{keyNode, valueNode})
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hosts {
+		group.RegisterHost(h)
+	}
+	for _, t := range tasks {
+		group.RegisterTask(t)
+	}
+
+	// apply the default values of the group like the lua's group.
+	for _, kv := range defaults {
+		keyNode, valueNode := kv[0], kv[1]
+		key := keyNode.Value
+
+		err := inv.update(keyNode, valueNode, func(L *lua.LState, value lua.LValue) {
+			group.LValues[key] = value
+			for _, h := range hosts {
+				if h.LValues[key] == nil {
+					updateHost(L, h, key, value)
+				}
+			}
+			for _, t := range tasks {
+				if t.LValues[key] == nil {
+					updateTask(L, t, key, value)
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// update converts the value node to the lua value and calls the fn in the protected mode.
+// The errors are reported with the position of the key.
+func (inv *inventoryLoader) update(keyNode *yaml.Node, valueNode *yaml.Node, fn func(L *lua.LState, value lua.LValue)) error {
+	value, err := inv.toLValue(valueNode)
+	if err != nil {
+		return err
+	}
+
+	err = inv.L.CallByParam(lua.P{
+		Fn: inv.L.NewFunction(func(L *lua.LState) int {
+			fn(L, value)
+			return 0
+		}),
+		NRet:    0,
+		Protect: true,
+	})
+	if err != nil {
+		msg := err.Error()
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			msg = apiErr.Object.String()
+		}
+		return inv.errorf(keyNode, "%s", strings.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func (inv *inventoryLoader) toLValue(node *yaml.Node) (lua.LValue, error) {
+	node = resolveAlias(node)
+
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if node.Tag == "!secret" {
+			secret, err := NewSecret(node.Value)
+			if err != nil {
+				return nil, inv.errorf(node, "%v", err)
+			}
+			return newLSecret(inv.L, secret), nil
+		}
+
+		var v interface{}
+		if err := node.Decode(&v); err != nil {
+			return nil, inv.errorf(node, "%v", err)
+		}
+
+		switch value := v.(type) {
+		case nil:
+			return lua.LNil, nil
+		case bool:
+			return lua.LBool(value), nil
+		case int:
+			return lua.LNumber(value), nil
+		case int64:
+			return lua.LNumber(value), nil
+		case uint64:
+			return lua.LNumber(value), nil
+		case float64:
+			return lua.LNumber(value), nil
+		}
+
+		return lua.LString(node.Value), nil
+	case yaml.SequenceNode:
+		tb := inv.L.NewTable()
+		for _, elem := range node.Content {
+			lv, err := inv.toLValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			tb.Append(lv)
+		}
+		return tb, nil
+	case yaml.MappingNode:
+		tb := inv.L.NewTable()
+		err := inv.mapping(node, "table", func(key string, keyNode *yaml.Node, valueNode *yaml.Node) error {
+			lv, err := inv.toLValue(valueNode)
+			if err != nil {
+				return err
+			}
+			tb.RawSetString(key, lv)
+			return nil
+		})
+		return tb, err
+	}
+
+	return nil, inv.errorf(node, "unsupported value")
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+
+	return node
+}
+
+// esshGetHost returns the host that has been defined in the config or inventory files, or nil.
+func esshGetHost(L *lua.LState) int {
+	name := L.CheckString(1)
+	if h := Hosts[name]; h != nil {
+		L.Push(newLHost(L, h))
+	} else {
+		L.Push(lua.LNil)
+	}
+
+	return 1
+}
+
+// esshGetTask returns the task that has been defined in the config or inventory files, or nil.
+func esshGetTask(L *lua.LState) int {
+	name := L.CheckString(1)
+	if t := Tasks[name]; t != nil {
+		L.Push(newLTask(L, t))
+	} else {
+		L.Push(lua.LNil)
+	}
+
+	return 1
+}
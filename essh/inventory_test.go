@@ -0,0 +1,109 @@
+package essh
+
+import (
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadTestInventory(t *testing.T, content string) (string, error) {
+	dir, err := ioutil.TempDir("", "essh.inventory_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "hosts.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	initResources()
+
+	L := lua.NewState()
+	defer L.Close()
+	InitLuaState(L)
+
+	return file, loadInventoryFile(L, file)
+}
+
+func TestLoadInventoryFile(t *testing.T) {
+	defer initResources()
+
+	file, err := loadTestInventory(t, `hosts:
+  web01:
+    HostName: 192.168.0.11
+    tags: [web]
+tasks:
+  uptime:
+    targets: web
+    script: uptime
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Hosts["web01"]
+	if h == nil {
+		t.Fatal("host 'web01' expected, but got nil")
+	}
+	if h.SSHConfig["HostName"] != "192.168.0.11" {
+		t.Errorf("'192.168.0.11' expected, but got '%s'", h.SSHConfig["HostName"])
+	}
+	if h.Source != file+":2" {
+		t.Errorf("'%s:2' expected, but got '%s'", file, h.Source)
+	}
+
+	if Tasks["uptime"] == nil {
+		t.Fatal("task 'uptime' expected, but got nil")
+	}
+}
+
+func TestLoadInventoryFileErrors(t *testing.T) {
+	defer initResources()
+
+	cases := []struct {
+		content string
+		// expected is the error after the file name.
+		expected string
+	}{
+		{
+			content:  "hosts:\n  web01:\n    HostName: a\n  web01:\n    HostName: b\n",
+			expected: ":4:3: duplicated key 'web01' (defined at line 2)",
+		},
+		{
+			content:  "hosts:\n  web01:\n    HostName: a\nservers:\n  web02: {}\n",
+			expected: ":4:1: unsupported inventory's key 'servers'. it must be 'hosts', 'tasks' or 'groups'.",
+		},
+		{
+			content:  "hosts:\n  - web01\n",
+			expected: ":2:3: expected mapping of hosts but got ''",
+		},
+		{
+			content:  "groups:\n  - drivers:\n      bash: {}\n",
+			expected: ":2:5: inventory files don't support drivers.",
+		},
+		{
+			content:  "hosts:\n  web01:\n    HostName: a\n  web02:\n    tags: {a: 1}\n",
+			expected: ":5:5: ",
+		},
+		{
+			content:  "hosts:\n  web01:\n    HostName: a\n\tPort: 22\n",
+			expected: ": line 3: found a tab character that violates indentation",
+		},
+	}
+
+	for _, c := range cases {
+		file, err := loadTestInventory(t, c.content)
+		if err == nil {
+			t.Errorf("an error '%s' expected, but got nil", c.expected)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), file+c.expected) {
+			t.Errorf("an error '%s%s' expected, but got '%v'", file, c.expected, err)
+		}
+	}
+}
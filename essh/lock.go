@@ -0,0 +1,328 @@
+package essh
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	TASK_LOCK_LOCAL  = "local"
+	TASK_LOCK_REMOTE = "remote"
+)
+
+// DefaultRemoteLockDir is a directory where remote locks are created.
+// It can be changed by 'essh.remote_lock_dir'.
+var DefaultRemoteLockDir = "/tmp"
+
+// DefaultLockTTL is seconds after that a remote lock is regarded as stale.
+var DefaultLockTTL = 3600
+
+// LockInfo is stored in a lock to show who holds it.
+type LockInfo struct {
+	User     string `json:"user"`
+	Hostname string `json:"hostname"`
+	Pid      int    `json:"pid"`
+	Since    int64  `json:"since"`
+}
+
+func NewLockInfo() *LockInfo {
+	hostname, _ := os.Hostname()
+	return &LockInfo{
+		User:     currentUsername(),
+		Hostname: hostname,
+		Pid:      os.Getpid(),
+		Since:    time.Now().Unix(),
+	}
+}
+
+func (info *LockInfo) String() string {
+	return fmt.Sprintf("%s@%s (pid %d) since %s", info.User, info.Hostname, info.Pid, time.Unix(info.Since, 0).Format(time.RFC3339))
+}
+
+// IsStale returns true if the process that holds the lock does not exist.
+// If the process can't be checked, because it is on the other host, the lock is stale after the ttl seconds.
+func (info *LockInfo) IsStale(ttl int) bool {
+	hostname, _ := os.Hostname()
+	if runtime.GOOS != "windows" && info.Hostname == hostname && info.Pid > 0 {
+		p, err := os.FindProcess(info.Pid)
+		if err != nil {
+			return true
+		}
+
+		err = p.Signal(syscall.Signal(0))
+		return err == os.ErrProcessDone || err == syscall.ESRCH
+	}
+
+	return ttl > 0 && time.Now().Unix()-info.Since > int64(ttl)
+}
+
+// TaskLock is a lock to prevent concurrent runs of a task.
+type TaskLock struct {
+	Task  *Task
+	Hosts []*Host
+	// acquired remote hosts
+	lockedHosts []*Host
+	localPath   string
+	config      string
+	remoteDir   string
+}
+
+func toLock(L *lua.LState, task *Task, value lua.LValue) {
+	if lockStr, ok := toString(value); ok {
+		task.Lock = lockStr
+	} else if lockTb, ok := toLTable(value); ok {
+		lockTb.ForEach(func(k, v lua.LValue) {
+			ks, _ := toString(k)
+			switch ks {
+			case "type":
+				if s, ok := toString(v); ok {
+					task.Lock = s
+				} else {
+					L.RaiseError("lock 'type' must be a string.")
+				}
+			case "ttl":
+				if f, ok := toFloat64(v); ok {
+					task.LockTTL = int(f)
+				} else {
+					L.RaiseError("lock 'ttl' must be a number.")
+				}
+			default:
+				L.RaiseError("unsupported lock's field '%v'.", k)
+			}
+		})
+	} else {
+		L.RaiseError("lock must be a string or table.")
+	}
+
+	if task.Lock != "" && task.Lock != TASK_LOCK_LOCAL && task.Lock != TASK_LOCK_REMOTE {
+		L.RaiseError("lock must be '%s' or '%s'.", TASK_LOCK_LOCAL, TASK_LOCK_REMOTE)
+	}
+}
+
+func NewTaskLock(L *lua.LState, config string, task *Task, hosts []*Host) (*TaskLock, error) {
+	lock := &TaskLock{
+		Task:        task,
+		Hosts:       hosts,
+		lockedHosts: []*Host{},
+		config:      config,
+		remoteDir:   DefaultRemoteLockDir,
+	}
+
+	registry := task.Registry
+	if registry == nil {
+		registry = CurrentRegistry
+	}
+	lock.localPath = filepath.Join(registry.LocksDir(), EnvKeyEscape(strings.Replace(task.Name, "/", "_", -1))+".lock")
+
+	if lessh, ok := toLTable(L.GetGlobal("essh")); ok {
+		if v := lessh.RawGetString("remote_lock_dir"); v != lua.LNil {
+			dir, ok := toString(v)
+			if !ok {
+				return nil, fmt.Errorf("invalid value %v in the 'remote_lock_dir'", v)
+			}
+			lock.remoteDir = dir
+		}
+	}
+
+	return lock, nil
+}
+
+func (lock *TaskLock) ttl() int {
+	if lock.Task.LockTTL > 0 {
+		return lock.Task.LockTTL
+	}
+	return DefaultLockTTL
+}
+
+func (lock *TaskLock) remotePath() string {
+	return lock.remoteDir + "/essh-" + EnvKeyEscape(strings.Replace(lock.Task.Name, "/", "_", -1)) + ".lock"
+}
+
+func (lock *TaskLock) Acquire() error {
+	switch lock.Task.Lock {
+	case TASK_LOCK_LOCAL:
+		return lock.acquireLocal(true)
+	case TASK_LOCK_REMOTE:
+		if len(lock.Hosts) == 0 {
+			return fmt.Errorf("lock '%s' requires target hosts.", TASK_LOCK_REMOTE)
+		}
+
+		for _, host := range lock.Hosts {
+			if err := lock.acquireRemote(host, true); err != nil {
+				lock.Release()
+				return err
+			}
+			lock.lockedHosts = append(lock.lockedHosts, host)
+		}
+	}
+
+	return nil
+}
+
+func (lock *TaskLock) Release() {
+	if lock == nil {
+		return
+	}
+
+	switch lock.Task.Lock {
+	case TASK_LOCK_LOCAL:
+		if err := os.Remove(lock.localPath); err != nil && !os.IsNotExist(err) {
+			printError(fmt.Errorf("failed to release the lock: %v", err))
+		}
+	case TASK_LOCK_REMOTE:
+		for _, host := range lock.lockedHosts {
+			if err := lock.releaseRemote(host); err != nil {
+				printError(fmt.Errorf("failed to release the lock on '%s': %v", host.Name, err))
+			}
+		}
+		lock.lockedHosts = []*Host{}
+	}
+}
+
+// ForceRelease removes the locks even if other processes hold them.
+func (lock *TaskLock) ForceRelease() error {
+	switch lock.Task.Lock {
+	case TASK_LOCK_LOCAL:
+		if err := os.Remove(lock.localPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Printf("Released the lock: %s\n", lock.localPath)
+	case TASK_LOCK_REMOTE:
+		for _, host := range lock.Hosts {
+			if err := lock.releaseRemote(host); err != nil {
+				return err
+			}
+			fmt.Printf("Released the lock: %s:%s\n", host.Name, lock.remotePath())
+		}
+	default:
+		return fmt.Errorf("task '%s' does not use a lock.", lock.Task.Name)
+	}
+
+	return nil
+}
+
+func (lock *TaskLock) acquireLocal(retry bool) error {
+	if err := os.MkdirAll(filepath.Dir(lock.localPath), os.FileMode(0755)); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(NewLockInfo())
+	if err != nil {
+		return err
+	}
+
+	// write the lock info to a temporary file and link it to the lock file,
+	// so that the other processes never read the lock file without the info.
+	tmp, err := ioutil.TempFile(filepath.Dir(lock.localPath), filepath.Base(lock.localPath)+".tmp.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Link(tmp.Name(), lock.localPath)
+	if err == nil {
+		return nil
+	}
+	if !os.IsExist(err) {
+		return err
+	}
+
+	b, err = ioutil.ReadFile(lock.localPath)
+	if err != nil {
+		if os.IsNotExist(err) && retry {
+			// the lock has been released just now.
+			return lock.acquireLocal(false)
+		}
+		return err
+	}
+
+	info := &LockInfo{}
+	if err := json.Unmarshal(b, info); err != nil {
+		return fmt.Errorf("task '%s' is locked by a broken lock file '%s'. use --force-unlock to remove it.", lock.Task.Name, lock.localPath)
+	}
+
+	if retry && info.IsStale(0) {
+		if debugFlag {
+			fmt.Printf("[essh debug] remove a stale lock: %s\n", lock.localPath)
+		}
+		os.Remove(lock.localPath)
+		return lock.acquireLocal(false)
+	}
+
+	return fmt.Errorf("task '%s' is locked by %s. use --force-unlock to remove the lock.", lock.Task.Name, info)
+}
+
+func (lock *TaskLock) acquireRemote(host *Host, retry bool) error {
+	b, err := json.Marshal(NewLockInfo())
+	if err != nil {
+		return err
+	}
+
+	path := ShellEscape(lock.remotePath())
+	script := "if mkdir " + path + " 2>/dev/null; then printf '%s' " + ShellEscape(string(b)) + " > " + path + "/info; echo __essh_lock_acquired; else cat " + path + "/info 2>/dev/null; fi"
+
+	cmd := exec.Command("ssh", "-F", lock.config, host.Name, script)
+	cmd.Stderr = os.Stderr
+	if debugFlag {
+		fmt.Printf("[essh debug] real lock command: %v \n", cmd.Args)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to acquire the lock on '%s': %v", host.Name, err)
+	}
+
+	output := strings.TrimSpace(string(out))
+	if output == "__essh_lock_acquired" {
+		return nil
+	}
+
+	if output == "" {
+		// the other process has created the lock directory, but hasn't written the info yet.
+		return fmt.Errorf("task '%s' is locked on '%s' by an unknown owner. use --force-unlock to remove the lock.", lock.Task.Name, host.Name)
+	}
+
+	info := &LockInfo{}
+	if err := json.Unmarshal([]byte(output), info); err != nil {
+		return fmt.Errorf("task '%s' is locked on '%s' by a broken lock '%s'. use --force-unlock to remove it.", lock.Task.Name, host.Name, lock.remotePath())
+	}
+
+	if retry && info.IsStale(lock.ttl()) {
+		if debugFlag {
+			fmt.Printf("[essh debug] remove a stale lock: %s:%s\n", host.Name, lock.remotePath())
+		}
+		if err := lock.releaseRemote(host); err != nil {
+			return err
+		}
+		return lock.acquireRemote(host, false)
+	}
+
+	return fmt.Errorf("task '%s' is locked on '%s' by %s. use --force-unlock to remove the lock.", lock.Task.Name, host.Name, info)
+}
+
+func (lock *TaskLock) releaseRemote(host *Host) error {
+	cmd := exec.Command("ssh", "-F", lock.config, host.Name, "rm -rf "+ShellEscape(lock.remotePath()))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if debugFlag {
+		fmt.Printf("[essh debug] real unlock command: %v \n", cmd.Args)
+	}
+
+	return cmd.Run()
+}
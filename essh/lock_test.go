@@ -0,0 +1,47 @@
+package essh
+
+import (
+	"os/exec"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLockInfoIsStale(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the process can't be checked on windows")
+	}
+
+	old := time.Now().Add(-2 * time.Hour).Unix()
+
+	// the lock of the alive process isn't stale even if it is older than the ttl.
+	info := NewLockInfo()
+	info.Since = old
+	if info.IsStale(3600) {
+		t.Errorf("the lock of the alive process expected not to be stale, but it is stale")
+	}
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	info = NewLockInfo()
+	info.Pid = cmd.Process.Pid
+	if !info.IsStale(3600) {
+		t.Errorf("the lock of the exited process expected to be stale, but it isn't stale")
+	}
+
+	// the process on the other host can't be checked, so the ttl is used.
+	info = NewLockInfo()
+	info.Hostname = "other-" + info.Hostname
+	if info.IsStale(3600) {
+		t.Errorf("the new lock on the other host expected not to be stale, but it is stale")
+	}
+	info.Since = old
+	if !info.IsStale(3600) {
+		t.Errorf("the old lock on the other host expected to be stale, but it isn't stale")
+	}
+	if info.IsStale(0) {
+		t.Errorf("the lock without the ttl expected not to be stale, but it is stale")
+	}
+}
@@ -12,7 +12,6 @@ import (
 	"github.com/yuin/gluare"
 	"github.com/yuin/gopher-lua"
 	gluajson "layeh.com/gopher-json"
-	"net/http"
 	"os"
 	"path/filepath"
 )
@@ -26,6 +25,9 @@ func InitLuaState(L *lua.LState) {
 	registerRegistryClass(L)
 	registerGroupClass(L)
 	registerModuleClass(L)
+	registerPolicyClass(L)
+	registerBackendClass(L)
+	registerSecretClass(L)
 
 	// global functions
 	L.SetGlobal("host", L.NewFunction(esshHost))
@@ -33,6 +35,8 @@ func InitLuaState(L *lua.LState) {
 	L.SetGlobal("driver", L.NewFunction(esshDriver))
 	L.SetGlobal("group", L.NewFunction(esshGroup))
 	L.SetGlobal("module", L.NewFunction(esshModule))
+	L.SetGlobal("policy", L.NewFunction(esshPolicy))
+	L.SetGlobal("backend", L.NewFunction(esshBackend))
 
 	// deprecated. for BC
 	L.SetGlobal("import", L.NewFunction(esshImport))
@@ -44,7 +48,7 @@ func InitLuaState(L *lua.LState) {
 	L.PreloadModule("template", gluatemplate.Loader)
 	L.PreloadModule("question", gluaquestion.Loader)
 	L.PreloadModule("env", gluaenv.Loader)
-	L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
+	L.PreloadModule("http", gluahttp.NewHttpModule(newHTTPClient()).Loader)
 	L.PreloadModule("re", gluare.Loader)
 	L.PreloadModule("sh", gluash.Loader)
 
@@ -54,19 +58,25 @@ func InitLuaState(L *lua.LState) {
 	lessh.RawSetString("ssh_config", lua.LNil)
 	lessh.RawSetString("version", lua.LString(Version))
 	lessh.RawSetString("module", lua.LNil)
+	lessh.RawSetString("profile", lua.LNil)
 
 	L.SetFuncs(lessh, map[string]lua.LGFunction{
 		// aliases global function.
-		"host":   esshHost,
-		"task":   esshTask,
-		"driver": esshDriver,
-		"group":  esshGroup,
-		"module": esshModule,
+		"host":    esshHost,
+		"task":    esshTask,
+		"driver":  esshDriver,
+		"group":   esshGroup,
+		"module":  esshModule,
+		"policy":  esshPolicy,
+		"backend": esshBackend,
 
 		// utility functions
 		"debug":            esshDebug,
 		"select_hosts":     esshSelectHosts,
 		"current_registry": esshCurrentRegistry,
+		"get_host":         esshGetHost,
+		"get_task":         esshGetTask,
+		"secret":           esshSecret,
 	})
 }
 
@@ -167,6 +177,11 @@ func toGoValue(lv lua.LValue) interface{} {
 			}
 			return ret
 		}
+	case *lua.LUserData:
+		if secret, ok := v.Value.(*Secret); ok {
+			return secret
+		}
+		return v
 	default:
 		return v
 	}
@@ -106,6 +106,11 @@ func (m *Module) Load(update bool) error {
 		update = false
 	}
 
+	if offlineFlag {
+		// use the installed one without updating.
+		return checkInstalledOffline(m.Name, dst)
+	}
+
 	if !update {
 		if _, err := os.Stat(dst); err == nil {
 			// If the directory already exists, then we're done since
@@ -207,8 +212,17 @@ func (m *Module) Evaluate() error {
 
 	lessh.RawSetString("module", modulevar)
 
-	if err := L.DoFile(indexFile); err != nil {
-		return err
+	if m.Sandboxed() {
+		if debugFlag {
+			fmt.Printf("[essh debug] module evaluating in sandbox '%s'\n", m.Name)
+		}
+		if err := doSandboxedFile(L, m, indexFile); err != nil {
+			return err
+		}
+	} else {
+		if err := L.DoFile(indexFile); err != nil {
+			return err
+		}
 	}
 
 	// remove pkg variable
@@ -296,6 +310,12 @@ func setupModule(L *lua.LState, h *Module, config *lua.LTable) {
 }
 
 func updateModule(L *lua.LState, h *Module, key string, value lua.LValue) {
+	if key == "sandbox" {
+		if _, ok := value.(lua.LBool); !ok {
+			panic("invalid value of a module's field '" + key + "'.")
+		}
+	}
+
 	h.LValues[key] = value
 }
 
@@ -0,0 +1,230 @@
+package essh
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/kohkimakimoto/essh/support/helper"
+	"github.com/yuin/gopher-lua"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MultiplexDefault enables the connection multiplexing of the hosts that don't set 'multiplex'.
+// It is set by 'essh.multiplex'.
+var MultiplexDefault = false
+
+// MultiplexPersist is a value of 'ControlPersist'. It is set by 'essh.multiplex_persist'.
+var MultiplexPersist = DefaultMultiplexPersist
+
+var DefaultMultiplexPersist = "10m"
+
+// MaxControlPathLen is a max length of the control socket paths.
+// The unix domain socket path is limited to 104 bytes on some platforms,
+// and ssh appends a temporary suffix (17 bytes) to the path while it creates the socket.
+var MaxControlPathLen = 104 - 17
+
+func loadMultiplexConfig(lessh *lua.LTable) error {
+	if v := lessh.RawGetString("multiplex"); v != lua.LNil {
+		multiplex, ok := toBool(v)
+		if !ok {
+			return fmt.Errorf("invalid value %v in the 'multiplex'", v)
+		}
+		MultiplexDefault = multiplex
+	}
+
+	if v := lessh.RawGetString("multiplex_persist"); v != lua.LNil {
+		persist, ok := toString(v)
+		if !ok {
+			// allow seconds as a number.
+			f, isNum := toFloat64(v)
+			if !isNum {
+				return fmt.Errorf("invalid value %v in the 'multiplex_persist'", v)
+			}
+			persist = fmt.Sprintf("%d", int(f))
+		}
+		MultiplexPersist = persist
+	}
+
+	return nil
+}
+
+// MultiplexEnabled returns true if the connections to the host are multiplexed by essh.
+func (h *Host) MultiplexEnabled() bool {
+	if h.SSHConfigValue("ControlMaster") != "" {
+		// respects the user's multiplexing config.
+		return false
+	}
+
+	if _, ok := h.LValues["multiplex"]; ok {
+		return h.Multiplex
+	}
+
+	return MultiplexDefault
+}
+
+// ControlPath returns a path of the control socket of the host.
+// It is keyed on the destination like '%C' of ssh, so that the hosts that have the same name
+// in different registries or the same host with different users don't share the socket.
+func (h *Host) ControlPath() string {
+	return filepath.Join(muxDir(h.Registry), fmt.Sprintf("%x", sha256.Sum256([]byte(h.muxDestination())))[:12])
+}
+
+// muxDestination returns the destination of the connections like "user@hostname:port".
+func (h *Host) muxDestination() string {
+	hostname := h.SSHConfigValue("HostName")
+	if hostname == "" {
+		hostname = h.Name
+	}
+
+	port := h.SSHConfigValue("Port")
+	if port == "" {
+		port = "22"
+	}
+
+	user := h.SSHConfigValue("User")
+	if user == "" {
+		user = currentUsername()
+	}
+
+	return user + "@" + hostname + ":" + port
+}
+
+// muxDir returns a directory for the control sockets.
+// It is in the registry cache. If the path is too long for the sockets, it uses a directory in the temporary directory.
+func muxDir(reg *Registry) string {
+	if reg == nil {
+		reg = CurrentRegistry
+	}
+
+	dir := filepath.Join(reg.CacheDir(), "mux")
+	if len(dir)+13 <= MaxControlPathLen {
+		return dir
+	}
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("essh-mux-%d-%s", os.Getuid(), reg.Key[:8]))
+}
+
+// GeneratedSSHConfig returns the ssh config that is written to the generated ssh_config file.
+// It includes the multiplexing options if the multiplexing is enabled.
+func (h *Host) GeneratedSSHConfig() []map[string]string {
+	values := h.SortedSSHConfig()
+	if !h.MultiplexEnabled() {
+		return values
+	}
+
+	controlPath := h.ControlPath()
+	if strings.Contains(controlPath, " ") {
+		controlPath = `"` + controlPath + `"`
+	}
+
+	return append(values,
+		map[string]string{"ControlMaster": "auto"},
+		map[string]string{"ControlPath": controlPath},
+		map[string]string{"ControlPersist": MultiplexPersist},
+	)
+}
+
+func mkMuxDirs(hosts []*Host) error {
+	for _, h := range hosts {
+		if h.MultiplexEnabled() {
+			if err := mkMuxDir(filepath.Dir(h.ControlPath())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mkMuxDir creates the directory for the control sockets.
+// The directory may be in the shared temporary directory, so it must be owned by the user and not be accessible by others.
+func mkMuxDir(dir string) error {
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("'%s' for the control sockets is not a directory.", dir)
+	}
+
+	return checkPrivateMuxDir(dir, fi)
+}
+
+func multiplexedHosts(hosts []*Host) []*Host {
+	ret := []*Host{}
+	for _, h := range hosts {
+		if h.MultiplexEnabled() {
+			ret = append(ret, h)
+		}
+	}
+	sort.Sort(NameSortableHosts(ret))
+
+	return ret
+}
+
+func printMuxStatus(config string, hosts []*Host) error {
+	tb := helper.NewPlainTable(os.Stdout)
+	if !quietFlag {
+		tb.SetHeader([]string{"NAME", "STATUS", "SOCKET"})
+	}
+
+	for _, h := range multiplexedHosts(hosts) {
+		status := "closed"
+		if _, err := os.Stat(h.ControlPath()); err == nil {
+			cmd := exec.Command("ssh", "-F", config, "-O", "check", h.Name)
+			if debugFlag {
+				fmt.Printf("[essh debug] real mux command: %v \n", cmd.Args)
+			}
+			if err := cmd.Run(); err == nil {
+				status = "running"
+			} else {
+				status = "stale"
+			}
+		}
+
+		if quietFlag {
+			if status == "running" {
+				tb.Append([]string{h.Name})
+			}
+		} else {
+			tb.Append([]string{h.Name, status, h.ControlPath()})
+		}
+	}
+	tb.Render()
+
+	return nil
+}
+
+func closeMux(config string, hosts []*Host) error {
+	for _, h := range multiplexedHosts(hosts) {
+		if _, err := os.Stat(h.ControlPath()); err != nil {
+			continue
+		}
+
+		cmd := exec.Command("ssh", "-F", config, "-O", "exit", h.Name)
+		if debugFlag {
+			fmt.Printf("[essh debug] real mux command: %v \n", cmd.Args)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			// the master process has gone. remove the stale socket.
+			if debugFlag {
+				fmt.Printf("[essh debug] %s", out)
+			}
+			if err := os.Remove(h.ControlPath()); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		fmt.Printf("Closed the connection: %s\n", h.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package essh
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// checkPrivateMuxDir returns an error if the directory is owned by another user or accessible by other users.
+func checkPrivateMuxDir(dir string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("'%s' for the control sockets is not owned by the current user.", dir)
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("'%s' for the control sockets must not be accessible by other users. the permission is %o.", dir, fi.Mode().Perm())
+	}
+
+	return nil
+}
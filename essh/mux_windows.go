@@ -0,0 +1,10 @@
+package essh
+
+import (
+	"os"
+)
+
+// checkPrivateMuxDir does nothing on windows, because ssh doesn't use the control sockets on it.
+func checkPrivateMuxDir(dir string, fi os.FileInfo) error {
+	return nil
+}
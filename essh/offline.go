@@ -0,0 +1,85 @@
+package essh
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// offlineTransport is a http transport that fails all the requests in offline mode.
+type offlineTransport struct{}
+
+func (t *offlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("essh is in offline mode. network access is not allowed.")
+}
+
+// newHTTPClient returns a http client that doesn't access the network in offline mode.
+func newHTTPClient() *http.Client {
+	if offlineFlag {
+		return &http.Client{Transport: &offlineTransport{}}
+	}
+
+	return &http.Client{}
+}
+
+// checkInstalledOffline returns an error if the module or package isn't installed in offline mode.
+func checkInstalledOffline(name string, dst string) error {
+	if _, err := os.Stat(dst); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("'%s' is not installed. it can't be installed in offline mode.", name)
+		}
+		return fmt.Errorf("Error reading directory: %s", err)
+	}
+
+	return nil
+}
+
+// scriptCacheFile returns the cache file of the remote script.
+func scriptCacheFile(url string) string {
+	return filepath.Join(GlobalRegistry.CacheDir(), "scripts", fmt.Sprintf("%x", sha256.Sum256([]byte(url))))
+}
+
+// getRemoteContent gets the content from the url and caches it.
+// In offline mode, it gets the content from the cache instead.
+func getRemoteContent(url string) ([]byte, error) {
+	if offlineFlag {
+		if GlobalRegistry != nil {
+			if b, err := ioutil.ReadFile(scriptCacheFile(url)); err == nil {
+				if debugFlag {
+					fmt.Printf("[essh debug] get script from the cache of '%s'\n", url)
+				}
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("'%s' is not in the cache. it can't be fetched in offline mode.", url)
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] get script using http from '%s'\n", url)
+	}
+
+	resp, err := newHTTPClient().Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusOK && GlobalRegistry != nil {
+		// the cache is used in offline mode. failing to write it doesn't fail the task.
+		cacheFile := scriptCacheFile(url)
+		if err := os.MkdirAll(filepath.Dir(cacheFile), 0755); err == nil {
+			if err := ioutil.WriteFile(cacheFile, b, 0644); err != nil && debugFlag {
+				fmt.Printf("[essh debug] failed to cache the script: %v\n", err)
+			}
+		}
+	}
+
+	return b, nil
+}
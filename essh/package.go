@@ -42,6 +42,11 @@ func (m *Package) Load(update bool) error {
 	src := m.Name
 	dst := m.Dir()
 
+	if offlineFlag {
+		// use the installed one without updating.
+		return checkInstalledOffline(m.Name, dst)
+	}
+
 	if !update {
 		if _, err := os.Stat(dst); err == nil {
 			// If the directory already exists, then we're done since
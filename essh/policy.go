@@ -0,0 +1,312 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+)
+
+type Policy struct {
+	Name        string
+	Description string
+	Check       *lua.LFunction
+	Registry    *Registry
+	LValues     map[string]lua.LValue
+}
+
+// Policies is all the registered policies. The policies are additive.
+// A policy that has the same name as the other one doesn't replace it, so that a project or a module can't disable the global policies.
+var Policies []*Policy
+
+const (
+	POLICY_ACTION_ALLOW   = "allow"
+	POLICY_ACTION_DENY    = "deny"
+	POLICY_ACTION_CONFIRM = "confirm"
+)
+
+// PolicyDecision is a result of evaluating a policy.
+type PolicyDecision struct {
+	Policy *Policy
+	Action string
+	Reason string
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		LValues: map[string]lua.LValue{},
+	}
+}
+
+func (p *Policy) MapLValuesToLTable(tb *lua.LTable) {
+	for key, value := range p.LValues {
+		tb.RawSetString(key, value)
+	}
+}
+
+func (p *Policy) Evaluate(L *lua.LState, task *Task, hosts []*Host, args []string) (*PolicyDecision, error) {
+	if p.Check == nil {
+		return nil, fmt.Errorf("invalid policy '%s'. The check function was not defined.", p.Name)
+	}
+
+	ctx := L.NewTable()
+	ctx.RawSetString("task", newLTask(L, task))
+	lhosts := L.NewTable()
+	for _, host := range hosts {
+		lhosts.Append(newLHost(L, host))
+	}
+	ctx.RawSetString("hosts", lhosts)
+	largs := L.NewTable()
+	for _, arg := range args {
+		largs.Append(lua.LString(arg))
+	}
+	ctx.RawSetString("args", largs)
+	ctx.RawSetString("user", lua.LString(currentUsername()))
+	ctx.RawSetString("privileged", lua.LBool(task.Privileged || task.User != ""))
+	ctx.RawSetString("backend", lua.LString(task.Backend))
+	if task.Module != nil {
+		ctx.RawSetString("module", lua.LString(task.Module.Name))
+	} else {
+		ctx.RawSetString("module", lua.LNil)
+	}
+
+	err := L.CallByParam(lua.P{
+		Fn:      p.Check,
+		NRet:    2,
+		Protect: true,
+	}, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("policy '%s' returned an error: %v", p.Name, err)
+	}
+
+	ret := L.Get(-2)
+	reason := L.Get(-1)
+	L.Pop(2)
+
+	d := &PolicyDecision{
+		Policy: p,
+		Action: POLICY_ACTION_ALLOW,
+	}
+	if reasonStr, ok := toString(reason); ok {
+		d.Reason = reasonStr
+	}
+
+	switch r := ret.(type) {
+	case *lua.LNilType:
+	case lua.LBool:
+		if !bool(r) {
+			d.Action = POLICY_ACTION_DENY
+		}
+	case lua.LString:
+		action := strings.ToLower(string(r))
+		if action != POLICY_ACTION_ALLOW && action != POLICY_ACTION_DENY && action != POLICY_ACTION_CONFIRM {
+			return nil, fmt.Errorf("policy '%s' returned an invalid action '%s'.", p.Name, action)
+		}
+		d.Action = action
+	default:
+		return nil, fmt.Errorf("policy '%s' must return a boolean or string.", p.Name)
+	}
+
+	return d, nil
+}
+
+func evaluatePolicies(L *lua.LState, task *Task, hosts []*Host, args []string) ([]*PolicyDecision, error) {
+	policies := make([]*Policy, len(Policies))
+	copy(policies, Policies)
+	sort.SliceStable(policies, func(i, j int) bool {
+		return policies[i].Name < policies[j].Name
+	})
+
+	decisions := []*PolicyDecision{}
+	for _, p := range policies {
+		if debugFlag {
+			fmt.Printf("[essh debug] evaluate policy: %s\n", p.Name)
+		}
+
+		d, err := p.Evaluate(L, task, hosts, args)
+		if err != nil {
+			return nil, err
+		}
+		decisions = append(decisions, d)
+	}
+
+	return decisions, nil
+}
+
+func deniedPoliciesError(decisions []*PolicyDecision) error {
+	denied := []string{}
+	for _, d := range decisions {
+		if d.Action == POLICY_ACTION_DENY {
+			if d.Reason != "" {
+				denied = append(denied, fmt.Sprintf("'%s' (%s)", d.Policy.Name, d.Reason))
+			} else {
+				denied = append(denied, fmt.Sprintf("'%s'", d.Policy.Name))
+			}
+		}
+	}
+
+	if len(denied) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("denied by policy %s", strings.Join(denied, ", "))
+}
+
+func policyConfirmMessages(decisions []*PolicyDecision) []string {
+	messages := []string{}
+	for _, d := range decisions {
+		if d.Action == POLICY_ACTION_CONFIRM {
+			if d.Reason != "" {
+				messages = append(messages, fmt.Sprintf("Policy '%s' requires confirmation: %s", d.Policy.Name, d.Reason))
+			} else {
+				messages = append(messages, fmt.Sprintf("Policy '%s' requires confirmation.", d.Policy.Name))
+			}
+		}
+	}
+
+	return messages
+}
+
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+func esshPolicy(L *lua.LState) int {
+	name := L.CheckString(1)
+	if L.GetTop() == 1 {
+		// object or DSL style
+		p := registerPolicy(L, name)
+		L.Push(newLPolicy(L, p))
+
+		return 1
+	} else if L.GetTop() == 2 {
+		p := registerPolicy(L, name)
+		if fn, ok := toLFunction(L.CheckAny(2)); ok {
+			// function style with a check function.
+			updatePolicy(L, p, "check", fn)
+		} else {
+			// function style
+			setupPolicy(L, p, L.CheckTable(2))
+		}
+		L.Push(newLPolicy(L, p))
+
+		return 1
+	}
+
+	panic("policy requires 1 or 2 arguments")
+}
+
+func registerPolicy(L *lua.LState, name string) *Policy {
+	if debugFlag {
+		fmt.Printf("[essh debug] register policy: %s\n", name)
+	}
+
+	p := NewPolicy()
+	p.Name = name
+	p.Registry = CurrentRegistry
+
+	Policies = append(Policies, p)
+
+	return p
+}
+
+func setupPolicy(L *lua.LState, p *Policy, config *lua.LTable) {
+	config.ForEach(func(k, v lua.LValue) {
+		if kstr, ok := toString(k); ok {
+			updatePolicy(L, p, kstr, v)
+		}
+	})
+}
+
+func updatePolicy(L *lua.LState, p *Policy, key string, value lua.LValue) {
+	p.LValues[key] = value
+
+	switch key {
+	case "description":
+		if descStr, ok := toString(value); ok {
+			p.Description = descStr
+		} else {
+			panic("invalid value of a policy's field '" + key + "'.")
+		}
+	case "check":
+		if checkFn, ok := toLFunction(value); ok {
+			p.Check = checkFn
+		} else {
+			L.RaiseError("policy 'check' have to be a function.")
+		}
+	default:
+		panic("unsupported policy's field '" + key + "'.")
+	}
+}
+
+const LPolicyClass = "Policy*"
+
+func registerPolicyClass(L *lua.LState) {
+	mt := L.NewTypeMetatable(LPolicyClass)
+	mt.RawSetString("__call", L.NewFunction(policyCall))
+	mt.RawSetString("__index", L.NewFunction(policyIndex))
+	mt.RawSetString("__newindex", L.NewFunction(policyNewindex))
+}
+
+func newLPolicy(L *lua.LState, policy *Policy) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = policy
+	L.SetMetatable(ud, L.GetTypeMetatable(LPolicyClass))
+	return ud
+}
+
+func checkPolicy(L *lua.LState) *Policy {
+	ud := L.CheckUserData(1)
+	if v, ok := ud.Value.(*Policy); ok {
+		return v
+	}
+	L.ArgError(1, "Policy object expected")
+	return nil
+}
+
+func policyCall(L *lua.LState) int {
+	policy := checkPolicy(L)
+	tb := L.CheckTable(2)
+
+	setupPolicy(L, policy, tb)
+
+	L.Push(L.CheckUserData(1))
+	return 1
+}
+
+func policyIndex(L *lua.LState) int {
+	policy := checkPolicy(L)
+	index := L.CheckString(2)
+
+	if index == "name" {
+		L.Push(L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString(policy.Name))
+			return 1
+		}))
+		return 1
+	}
+
+	v, ok := policy.LValues[index]
+	if v == nil || !ok {
+		v = lua.LNil
+	}
+
+	L.Push(v)
+	return 1
+}
+
+func policyNewindex(L *lua.LState) int {
+	policy := checkPolicy(L)
+	index := L.CheckString(2)
+	value := L.CheckAny(3)
+
+	updatePolicy(L, policy, index, value)
+
+	return 0
+}
@@ -0,0 +1,31 @@
+package essh
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+var profileNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func validateProfileName(name string) error {
+	if !profileNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid profile name '%s'. it must consist of alphanumeric characters, '_', '.' or '-'.", name)
+	}
+
+	return nil
+}
+
+// profileConfigFile returns the overlay config file of the profile.
+// For instance, the file of the profile "prod" for ".esshconfig.lua" is ".esshconfig.prod.lua".
+func profileConfigFile(configFile string, profile string) string {
+	ext := filepath.Ext(configFile)
+	return configFile[0:len(configFile)-len(ext)] + "." + profile + ext
+}
+
+// printProfileHeader prints the active profile before the listings.
+func printProfileHeader() {
+	if profileVar != "" && !quietFlag {
+		fmt.Printf("profile: %s\n\n", profileVar)
+	}
+}
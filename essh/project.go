@@ -0,0 +1,55 @@
+package essh
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ProjectRootMarker is a file that stops searching the project config file in the parent directories.
+var ProjectRootMarker = ".essh-root"
+
+// ProjectConfigFileNames are names of the project config file. The former takes precedence.
+var ProjectConfigFileNames = []string{
+	// This is for Backward Compatibility
+	"esshconfig.lua",
+	".esshconfig.lua",
+}
+
+// findProjectDir searches the directory that has the project config file, the conf.d or inventory directory
+// from the dir to the parent directories like git.
+// It stops at the filesystem root or the directory that has the ProjectRootMarker.
+// It returns the directory and the config file, or empty strings if the config file is not found.
+// If the directory has only the conf.d or inventory directory, the config file is the default one that may not exist.
+func findProjectDir(dir string) (string, string) {
+	for {
+		if debugFlag {
+			fmt.Printf("[essh debug] searching config file in: %s\n", dir)
+		}
+
+		for _, name := range ProjectConfigFileNames {
+			configFile := filepath.Join(dir, name)
+			if _, err := os.Stat(configFile); err == nil {
+				return dir, configFile
+			}
+		}
+
+		if hasProjectDataDir(filepath.Join(dir, ".essh")) {
+			return dir, filepath.Join(dir, ProjectConfigFileNames[len(ProjectConfigFileNames)-1])
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, ProjectRootMarker)); err == nil {
+			if debugFlag {
+				fmt.Printf("[essh debug] found %s in: %s\n", ProjectRootMarker, dir)
+			}
+			return "", ""
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			// filesystem root
+			return "", ""
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,120 @@
+package essh
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PropEnv is an environment variable that is generated from a prop.
+type PropEnv struct {
+	Key   string
+	Value string
+}
+
+// toProps converts a lua table to props. The values can be strings, numbers, booleans, secrets and tables of them.
+func toProps(L *lua.LState, propsTb *lua.LTable) map[string]interface{} {
+	props := map[string]interface{}{}
+
+	propsTb.ForEach(func(propsKey lua.LValue, propsValue lua.LValue) {
+		propsKeyStr, ok := toString(propsKey)
+		if !ok {
+			L.RaiseError("props table's key must be a string: %v", propsKey)
+		}
+		if !isPropValue(propsValue) {
+			L.RaiseError("props table's value must be a string, number, boolean, secret or table of them: %v", propsValue)
+		}
+
+		props[propsKeyStr] = toGoValue(propsValue)
+	})
+
+	return props
+}
+
+func isPropValue(lv lua.LValue) bool {
+	switch v := lv.(type) {
+	case lua.LString, lua.LNumber, lua.LBool:
+		return true
+	case *lua.LTable:
+		ok := true
+		v.ForEach(func(key, value lua.LValue) {
+			if !isPropValue(key) || !isPropValue(value) {
+				ok = false
+			}
+		})
+		return ok
+	case *lua.LUserData:
+		_, ok := v.Value.(*Secret)
+		return ok
+	}
+
+	return false
+}
+
+// PropString returns a string of the prop's value. The structured values are encoded as JSON.
+func PropString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	case *Secret:
+		return v.String()
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(b)
+}
+
+// FlattenProps returns the environment variables of the props.
+// A structured value is exported as JSON, and its elements are exported with the names that have the keys or indexes
+// like "ESSH_HOST_PROPS_SERVICES_0_PORT". The secrets are decrypted.
+func FlattenProps(prefix string, props map[string]interface{}) ([]*PropEnv, error) {
+	envs := []*PropEnv{}
+
+	var flatten func(key string, value interface{})
+	flatten = func(key string, value interface{}) {
+		envs = append(envs, &PropEnv{Key: key, Value: PropString(value)})
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			for _, k := range sortedKeys(v) {
+				flatten(key+"_"+EnvKeyEscape(strings.ToUpper(k)), v[k])
+			}
+		case []interface{}:
+			for i, e := range v {
+				flatten(fmt.Sprintf("%s_%d", key, i), e)
+			}
+		}
+	}
+
+	for _, k := range sortedKeys(props) {
+		value, err := revealProps(props[k])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt the prop '%s': %v", k, err)
+		}
+		flatten(prefix+"_"+EnvKeyEscape(strings.ToUpper(k)), value)
+	}
+
+	return envs, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
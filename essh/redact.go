@@ -0,0 +1,236 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactMask is a string that replaces the sensitive values in the outputs.
+const RedactMask = "***"
+
+// DefaultRedactPatterns is patterns of the keys of the sensitive props, env and args.
+// It can be changed by 'essh.redact_patterns'.
+var DefaultRedactPatterns = []string{
+	"password",
+	"passwd",
+	"secret",
+	"token",
+	"credential",
+	"api_?key",
+	"private_?key",
+}
+
+// minSensitiveValueLength is a length of the shortest value that is replaced in the outputs.
+// Shorter values would replace many unrelated parts of the outputs.
+const minSensitiveValueLength = 4
+
+var (
+	redactRegexps []*regexp.Regexp
+	// sensitiveValues is the values of the sensitive props, env, args and the decrypted secrets
+	// that are replaced in the outputs.
+	sensitiveValues  []string
+	sensitiveValuesM sync.Mutex
+)
+
+var argKeyValueRegexp = regexp.MustCompile(`^-*([A-Za-z0-9_.-]+)=(.*)$`)
+
+// toSensitive converts the value of the 'sensitive' field that is a table of the keys.
+func toSensitive(value lua.LValue) ([]string, bool) {
+	tb, ok := toLTable(value)
+	if !ok {
+		return nil, false
+	}
+
+	sensitive := []string{}
+	ok = true
+	tb.ForEach(func(_ lua.LValue, v lua.LValue) {
+		if key, isString := toString(v); isString {
+			sensitive = append(sensitive, key)
+		} else {
+			ok = false
+		}
+	})
+
+	return sensitive, ok
+}
+
+func loadRedactConfig(lessh *lua.LTable) error {
+	patterns := DefaultRedactPatterns
+
+	if v := lessh.RawGetString("redact_patterns"); v != lua.LNil {
+		tb, ok := toLTable(v)
+		if !ok {
+			return fmt.Errorf("invalid value %v in the 'redact_patterns'", v)
+		}
+
+		patterns = []string{}
+		var err error
+		tb.ForEach(func(_ lua.LValue, p lua.LValue) {
+			if pStr, ok := toString(p); ok {
+				patterns = append(patterns, pStr)
+			} else {
+				err = fmt.Errorf("invalid value %v in the 'redact_patterns'", p)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	redactRegexps = []*regexp.Regexp{}
+	for _, p := range patterns {
+		// the keys are matched case-insensitively.
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return fmt.Errorf("invalid pattern '%s' in the 'redact_patterns': %v", p, err)
+		}
+		redactRegexps = append(redactRegexps, re)
+	}
+
+	return nil
+}
+
+// isSensitiveKey returns true if the key matches the redact patterns or is one of the keys marked sensitive.
+func isSensitiveKey(key string, sensitive []string) bool {
+	for _, s := range sensitive {
+		if strings.EqualFold(s, key) {
+			return true
+		}
+	}
+
+	for _, re := range redactRegexps {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func addSensitiveValue(value string) {
+	if len(value) < minSensitiveValueLength {
+		return
+	}
+
+	sensitiveValuesM.Lock()
+	defer sensitiveValuesM.Unlock()
+
+	for _, v := range sensitiveValues {
+		if v == value {
+			return
+		}
+	}
+	sensitiveValues = append(sensitiveValues, value)
+
+	// the longer values are replaced first, so that a value in another value doesn't leave a part of it.
+	sort.SliceStable(sensitiveValues, func(i, j int) bool {
+		return len(sensitiveValues[i]) > len(sensitiveValues[j])
+	})
+}
+
+// redact replaces the sensitive values in the string with the RedactMask.
+// The values that are quoted by ShellEscape are also replaced.
+func redact(s string) string {
+	sensitiveValuesM.Lock()
+	defer sensitiveValuesM.Unlock()
+
+	for _, value := range sensitiveValues {
+		for i, quoted := 0, value; i < 3; i++ {
+			s = strings.Replace(s, quoted, RedactMask, -1)
+			quoted = strings.Replace(quoted, "'", "'\"'\"'", -1)
+		}
+	}
+
+	return s
+}
+
+// redactProps returns a copy of the props that has the RedactMask instead of the values of the sensitive keys.
+func redactProps(props map[string]interface{}, sensitive []string) map[string]interface{} {
+	var redactValue func(value interface{}) interface{}
+	redactValue = func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			ret := map[string]interface{}{}
+			for key, elem := range v {
+				if isSensitiveKey(key, sensitive) {
+					ret[key] = RedactMask
+				} else {
+					ret[key] = redactValue(elem)
+				}
+			}
+			return ret
+		case []interface{}:
+			ret := make([]interface{}, 0, len(v))
+			for _, elem := range v {
+				ret = append(ret, redactValue(elem))
+			}
+			return ret
+		}
+		return value
+	}
+
+	return redactValue(props).(map[string]interface{})
+}
+
+// redactArgs returns a copy of the args that has the RedactMask instead of the sensitive values.
+// If all is true, all the args are sensitive. Otherwise the args like "token=xxx" are checked by the key.
+func redactArgs(args []string, sensitive []string, all bool) []string {
+	ret := make([]string, 0, len(args))
+	for _, arg := range args {
+		if all {
+			ret = append(ret, RedactMask)
+		} else if m := argKeyValueRegexp.FindStringSubmatch(arg); m != nil && isSensitiveKey(m[1], sensitive) {
+			ret = append(ret, strings.TrimSuffix(arg, m[2])+RedactMask)
+		} else {
+			ret = append(ret, redact(arg))
+		}
+	}
+
+	return ret
+}
+
+// collectSensitiveValues collects the values of the sensitive props, env and args of the task and the host,
+// so that they are replaced in the outputs.
+func collectSensitiveValues(task *Task, host *Host) {
+	collectSensitiveProps(task.Props, task.Sensitive, false)
+	if host != nil {
+		collectSensitiveProps(host.Props, host.Sensitive, false)
+	}
+
+	for key, value := range task.Env {
+		if isSensitiveKey(key, task.Sensitive) {
+			addSensitiveValue(value)
+		}
+	}
+
+	for _, arg := range task.Args {
+		if task.SensitiveArgs {
+			addSensitiveValue(arg)
+		} else if m := argKeyValueRegexp.FindStringSubmatch(arg); m != nil && isSensitiveKey(m[1], task.Sensitive) {
+			addSensitiveValue(m[2])
+		}
+	}
+}
+
+func collectSensitiveProps(value interface{}, sensitive []string, isSensitive bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			collectSensitiveProps(elem, sensitive, isSensitive || isSensitiveKey(key, sensitive))
+		}
+	case []interface{}:
+		for _, elem := range v {
+			collectSensitiveProps(elem, sensitive, isSensitive)
+		}
+	case *Secret:
+		// the decrypted secrets are always collected by Reveal.
+	default:
+		if isSensitive {
+			addSensitiveValue(PropString(v))
+		}
+	}
+}
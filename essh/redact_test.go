@@ -0,0 +1,150 @@
+package essh
+
+import (
+	"github.com/yuin/gopher-lua"
+	"reflect"
+	"testing"
+)
+
+func setTestSensitiveValues(t *testing.T, values ...string) func() {
+	L := lua.NewState()
+	defer L.Close()
+
+	origValues := sensitiveValues
+	origRegexps := redactRegexps
+
+	if err := loadRedactConfig(L.NewTable()); err != nil {
+		t.Fatal(err)
+	}
+	sensitiveValues = []string{}
+	for _, v := range values {
+		addSensitiveValue(v)
+	}
+
+	return func() {
+		sensitiveValues = origValues
+		redactRegexps = origRegexps
+	}
+}
+
+func TestRedact(t *testing.T) {
+	cases := []struct {
+		values   []string
+		input    string
+		expected string
+	}{
+		{
+			values:   []string{"s3cr3t"},
+			input:    "password is s3cr3t and s3cr3t",
+			expected: "password is *** and ***",
+		},
+		{
+			// the values shorter than minSensitiveValueLength are not replaced.
+			values:   []string{"abc"},
+			input:    "abc abcd",
+			expected: "abc abcd",
+		},
+		{
+			// the longer value is replaced first even if the shorter one is added first.
+			values:   []string{"pass", "passphrase"},
+			input:    "passphrase pass",
+			expected: "*** ***",
+		},
+		{
+			values:   []string{"it's secret"},
+			input:    "echo " + ShellEscape("it's secret"),
+			expected: "echo '***'",
+		},
+		{
+			// the value that is quoted twice like "sh -c 'echo ...'".
+			values:   []string{"it's secret"},
+			input:    "sh -c " + ShellEscape("echo "+ShellEscape("it's secret")),
+			expected: "sh -c 'echo '\"'\"'***'\"'\"''",
+		},
+	}
+
+	for _, c := range cases {
+		restore := setTestSensitiveValues(t, c.values...)
+		if ret := redact(c.input); ret != c.expected {
+			t.Errorf("'%s' expected, but got '%s' (values: %v)", c.expected, ret, c.values)
+		}
+		restore()
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	defer setTestSensitiveValues(t, "s3cr3t")()
+
+	cases := []struct {
+		args      []string
+		sensitive []string
+		all       bool
+		expected  []string
+	}{
+		{
+			args:     []string{"v1.2", "--token=abcd", "api_key=xyz", "name=web"},
+			expected: []string{"v1.2", "--token=***", "api_key=***", "name=web"},
+		},
+		{
+			// the keys marked sensitive are matched case-insensitively.
+			args:      []string{"DB_PASS=abcd", "db_host=localhost"},
+			sensitive: []string{"db_pass"},
+			expected:  []string{"DB_PASS=***", "db_host=localhost"},
+		},
+		{
+			// the known sensitive values are replaced in the other args.
+			args:     []string{"--message=it is s3cr3t", "'s3cr3t'"},
+			expected: []string{"--message=it is ***", "'***'"},
+		},
+		{
+			args:     []string{"v1.2", "name=web"},
+			all:      true,
+			expected: []string{"***", "***"},
+		},
+	}
+
+	for _, c := range cases {
+		if ret := redactArgs(c.args, c.sensitive, c.all); !reflect.DeepEqual(ret, c.expected) {
+			t.Errorf("%v expected, but got %v", c.expected, ret)
+		}
+	}
+}
+
+func TestRedactProps(t *testing.T) {
+	defer setTestSensitiveValues(t)()
+
+	props := map[string]interface{}{
+		"name":     "web01",
+		"password": "abcd",
+		"db": map[string]interface{}{
+			"host":    "localhost",
+			"ApiKey":  "xyz",
+			"account": "admin",
+		},
+		"services": []interface{}{
+			map[string]interface{}{"name": "api", "token": "abcd"},
+		},
+	}
+
+	expected := map[string]interface{}{
+		"name":     "web01",
+		"password": RedactMask,
+		"db": map[string]interface{}{
+			"host":    "localhost",
+			"ApiKey":  RedactMask,
+			"account": RedactMask,
+		},
+		"services": []interface{}{
+			map[string]interface{}{"name": "api", "token": RedactMask},
+		},
+	}
+
+	if ret := redactProps(props, []string{"account"}); !reflect.DeepEqual(ret, expected) {
+		t.Errorf("%v expected, but got %v", expected, ret)
+	}
+
+	// the props are copied.
+	if props["password"] != "abcd" {
+		t.Errorf("the original props are not changed expected, but got %v", props["password"])
+	}
+}
@@ -51,6 +51,10 @@ func (ctx *Registry) CacheDir() string {
 	return filepath.Join(ctx.DataDir, "cache")
 }
 
+func (reg *Registry) LocksDir() string {
+	return filepath.Join(reg.DataDir, "locks")
+}
+
 func (reg *Registry) MkDirs() error {
 	if _, err := os.Stat(reg.PackagesDir()); os.IsNotExist(err) {
 		err = os.MkdirAll(reg.PackagesDir(), os.FileMode(0755))
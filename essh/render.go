@@ -0,0 +1,169 @@
+package essh
+
+import (
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"sort"
+	"strings"
+)
+
+// renderTask prints the scripts that the driver generates for the task on the host.
+// The host may be nil to render the script of a local task without hosts.
+func renderTask(L *lua.LState, config string, task *Task, host *Host, args []string) error {
+	// the secrets are not decrypted for the preview.
+	secretsMasked = true
+
+	// the task's prepare function isn't run, because the preview must not have its side effects.
+	setTaskArgs(L, task, args)
+	if err := task.ResolveEnv(); err != nil {
+		return err
+	}
+	collectSensitiveValues(task, nil)
+
+	tasks := []*Task{task}
+	if len(task.Steps) > 0 {
+		tasks = task.Steps
+		for _, step := range tasks {
+			if err := inheritTaskValues(task, step); err != nil {
+				return err
+			}
+			step.StepOutputs = map[string]string{}
+		}
+	}
+
+	for i, t := range tasks {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := printRenderedScript(config, t, host); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func printRenderedScript(config string, task *Task, host *Host) error {
+	driverName := task.Driver
+	if driverName == "" {
+		driverName = DefaultDriverName
+	}
+
+	driver := Drivers[driverName]
+	if driver == nil {
+		return fmt.Errorf("invalid driver name '%s'", driverName)
+	}
+
+	templates, err := driver.Templates()
+	if err != nil {
+		return err
+	}
+
+	collectSensitiveValues(task, host)
+
+	dict, err := driver.TemplateData(config, task, host)
+	if err != nil {
+		return err
+	}
+
+	script, err := driver.GenerateRunnableContent(config, task, host)
+	if err != nil {
+		return fmt.Errorf("failed to render the task '%s' by the driver '%s': %v", task.Name, driver.Name, err)
+	}
+
+	chain := []string{}
+	for _, t := range templates {
+		chain = append([]string{t.Name}, chain...)
+	}
+
+	fmt.Printf("task: %s\n", task.Name)
+	if task.StepName != "" {
+		fmt.Printf("step: %s\n", task.StepName)
+	}
+	if host != nil {
+		fmt.Printf("host: %s\n", host.Name)
+	}
+	fmt.Printf("driver: %s (templates: %s)\n", driver.Name, strings.Join(chain, " -> "))
+	fmt.Printf("interpreter: %s\n", driver.InterpreterName())
+
+	fmt.Printf("\nvariables:\n")
+	for _, kv := range templateVariables(dict) {
+		fmt.Printf("  %s = %s\n", kv[0], kv[1])
+	}
+
+	fmt.Printf("\nscript:\n")
+	lines := strings.Split(strings.TrimRight(script, "\n"), "\n")
+	width := len(fmt.Sprintf("%d", len(lines)))
+	for i, line := range lines {
+		fmt.Printf("%*d | %s\n", width, i+1, redact(line))
+	}
+
+	return nil
+}
+
+// templateVariables returns the names of the template variables and their values. The sensitive values are redacted.
+func templateVariables(dict map[string]interface{}) [][2]string {
+	vars := [][2]string{}
+	add := func(name string, value interface{}) {
+		vars = append(vars, [2]string{name, fmt.Sprintf("%q", redact(fmt.Sprintf("%v", value)))})
+	}
+	addMap := func(prefix string, m map[string]string) {
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			add(prefix+"."+k, m[k])
+		}
+	}
+	addProps := func(prefix string, props map[string]interface{}, sensitive []string) {
+		props = redactProps(props, sensitive)
+		for _, k := range sortedKeys(props) {
+			add(prefix+"."+k, PropString(props[k]))
+		}
+	}
+
+	add(".GOARCH", dict["GOARCH"])
+	add(".GOOS", dict["GOOS"])
+	add(".Debug", dict["Debug"])
+	add(".SSHConfigPath", dict["SSHConfigPath"])
+
+	driver := dict["Driver"].(*Driver)
+	add(".Driver.Name", driver.Name)
+	driverProps := map[string]string{}
+	for k, v := range driver.Props {
+		if str, isString := v.(string); isString && k != "engine" {
+			driverProps[k] = str
+		}
+	}
+	addMap(".Driver.Props", driverProps)
+	add(".Interpreter.Name", dict["Interpreter"].(*Interpreter).Name)
+
+	task := dict["Task"].(*Task)
+	add(".Task.Name", task.Name)
+	if task.StepName != "" {
+		add(".Task.StepName", task.StepName)
+	}
+	for i, arg := range task.Args {
+		add(fmt.Sprintf(".Task.Args.%d", i), arg)
+	}
+	addProps(".Task.Props", task.Props, task.Sensitive)
+	addMap(".Task.Env", task.Env)
+	addMap(".Task.StepOutputs", task.StepOutputs)
+
+	if host, ok := dict["Host"].(*Host); ok && host != nil {
+		add(".Host.Name", host.Name)
+		addProps(".Host.Props", host.Props, host.Sensitive)
+		addMap(".Host.SSHConfig", host.SSHConfig)
+		for i, tag := range host.Tags {
+			add(fmt.Sprintf(".Host.Tags.%d", i), tag)
+		}
+	}
+
+	for i, script := range dict["Scripts"].([]map[string]string) {
+		addMap(fmt.Sprintf(".Scripts.%d", i), script)
+	}
+
+	return vars
+}
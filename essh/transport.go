@@ -0,0 +1,499 @@
+package essh
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/crypto/ssh/terminal"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TRANSPORT_SSH runs remote tasks by spawning the ssh command.
+	TRANSPORT_SSH = "ssh"
+	// TRANSPORT_GO runs remote tasks by the built-in ssh client.
+	TRANSPORT_GO = "go"
+)
+
+var DefaultTransport = TRANSPORT_SSH
+
+// DefaultIdentityFiles are private keys that are used when a host does not have 'IdentityFile'.
+var DefaultIdentityFiles = []string{
+	"~/.ssh/id_rsa",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_ed25519",
+}
+
+var DefaultKnownHostsFile = "~/.ssh/known_hosts"
+
+func (t *Task) TransportOrDefault() string {
+	if transportVar != "" {
+		return transportVar
+	}
+
+	if t.Transport != "" {
+		return t.Transport
+	}
+
+	return DefaultTransport
+}
+
+// goSSHClientPool keeps connections of the built-in ssh client,
+// so that the tasks and steps reuse a connection to a host.
+type goSSHClientPool struct {
+	clients map[string]*ssh.Client
+	// jumps is connections to the ProxyJump hosts.
+	jumps []*ssh.Client
+	// hostMutexes are held while connecting to the hosts.
+	hostMutexes map[string]*sync.Mutex
+	m           sync.Mutex
+}
+
+var goSSHClients = &goSSHClientPool{
+	clients:     map[string]*ssh.Client{},
+	jumps:       []*ssh.Client{},
+	hostMutexes: map[string]*sync.Mutex{},
+}
+
+func getGoSSHClient(host *Host) (*ssh.Client, error) {
+	// the lock of the host is held while dialing, so that connecting to a host doesn't block the other hosts.
+	hm := goSSHClients.hostMutex(host.Name)
+	hm.Lock()
+	defer hm.Unlock()
+
+	goSSHClients.m.Lock()
+	client, ok := goSSHClients.clients[host.Name]
+	goSSHClients.m.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	client, jumps, err := dialGoSSH(host)
+	if err != nil {
+		return nil, err
+	}
+
+	goSSHClients.m.Lock()
+	defer goSSHClients.m.Unlock()
+
+	goSSHClients.clients[host.Name] = client
+	goSSHClients.jumps = append(goSSHClients.jumps, jumps...)
+
+	return client, nil
+}
+
+func (p *goSSHClientPool) hostMutex(name string) *sync.Mutex {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	hm, ok := p.hostMutexes[name]
+	if !ok {
+		hm = &sync.Mutex{}
+		p.hostMutexes[name] = hm
+	}
+
+	return hm
+}
+
+func closeGoSSHClients() {
+	goSSHClients.m.Lock()
+	defer goSSHClients.m.Unlock()
+
+	for name, client := range goSSHClients.clients {
+		client.Close()
+		delete(goSSHClients.clients, name)
+	}
+
+	// close from the nearest jump host.
+	for i := len(goSSHClients.jumps) - 1; i >= 0; i-- {
+		goSSHClients.jumps[i].Close()
+	}
+	goSSHClients.jumps = []*ssh.Client{}
+}
+
+// dialGoSSH connects to the host through the ProxyJump hosts.
+// It returns the connection to the host and the connections to the jump hosts.
+func dialGoSSH(host *Host) (*ssh.Client, []*ssh.Client, error) {
+	jumps := []*ssh.Client{}
+	var client *ssh.Client
+
+	if proxyJump := host.SSHConfigValue("ProxyJump"); proxyJump != "" && strings.ToLower(proxyJump) != "none" {
+		for _, spec := range strings.Split(proxyJump, ",") {
+			jumpClient, err := dialGoSSHVia(client, jumpHost(strings.TrimSpace(spec)))
+			if err != nil {
+				closeClients(jumps)
+				return nil, nil, err
+			}
+			jumps = append(jumps, jumpClient)
+			client = jumpClient
+		}
+	}
+
+	client, err := dialGoSSHVia(client, host)
+	if err != nil {
+		closeClients(jumps)
+		return nil, nil, err
+	}
+
+	return client, jumps, nil
+}
+
+func dialGoSSHVia(via *ssh.Client, host *Host) (*ssh.Client, error) {
+	// the keys of ssh-agent sign through the connection in the handshake. it is closed after connecting.
+	agentConn := dialSSHAgent(host)
+	if agentConn != nil {
+		defer agentConn.Close()
+	}
+
+	config, addr, err := goSSHClientConfig(host, agentConn)
+	if err != nil {
+		return nil, err
+	}
+
+	if debugFlag {
+		fmt.Printf("[essh debug] connect by the built-in ssh client: %s@%s\n", config.User, addr)
+	}
+
+	if via == nil {
+		client, err := ssh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to '%s': %v", host.Name, err)
+		}
+		return client, nil
+	}
+
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to '%s' through the jump host: %v", host.Name, err)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect to '%s': %v", host.Name, err)
+	}
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		clients[i].Close()
+	}
+}
+
+// jumpHost returns a host of the ProxyJump's value like "[user@]host[:port]".
+// If the host is defined in the config, it uses the defined ssh config.
+func jumpHost(spec string) *Host {
+	user := ""
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		user = spec[:i]
+		spec = spec[i+1:]
+	}
+
+	name := spec
+	port := ""
+	if h, p, err := net.SplitHostPort(spec); err == nil {
+		name = h
+		port = p
+	}
+
+	host := NewHost()
+	host.Name = name
+	if defined := Hosts[name]; defined != nil {
+		for k, v := range defined.SSHConfig {
+			host.SSHConfig[k] = v
+		}
+	}
+
+	if user != "" {
+		host.SetSSHConfigValue("User", user)
+	}
+	if port != "" {
+		host.SetSSHConfigValue("Port", port)
+	}
+
+	return host
+}
+
+// goSSHClientConfig returns a client config and an address of the host from the host's ssh config.
+func goSSHClientConfig(host *Host, agentConn net.Conn) (*ssh.ClientConfig, string, error) {
+	hostname := host.SSHConfigValue("HostName")
+	if hostname == "" {
+		hostname = host.Name
+	}
+
+	port := host.SSHConfigValue("Port")
+	if port == "" {
+		port = "22"
+	}
+
+	user := host.SSHConfigValue("User")
+	if user == "" {
+		user = currentUsername()
+	}
+
+	addr := net.JoinHostPort(hostname, port)
+
+	signers, err := goSSHSigners(host, agentConn)
+	if err != nil {
+		return nil, "", err
+	}
+
+	config := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				return signers, nil
+			}),
+		},
+	}
+
+	if strings.ToLower(host.SSHConfigValue("StrictHostKeyChecking")) == "no" {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		callback, err := goSSHKnownHostsCallback(host)
+		if err != nil {
+			return nil, "", err
+		}
+		config.HostKeyCallback = callback
+		config.HostKeyAlgorithms = knownHostKeyAlgorithms(callback, addr)
+	}
+
+	if timeout := host.SSHConfigValue("ConnectTimeout"); timeout != "" {
+		sec, err := strconv.Atoi(timeout)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid ConnectTimeout '%s' of the host '%s'", timeout, host.Name)
+		}
+		config.Timeout = time.Duration(sec) * time.Second
+	}
+
+	return config, addr, nil
+}
+
+// goSSHSigners returns the keys of the host's 'IdentityFile' or the default identity files, and ssh-agent.
+func goSSHSigners(host *Host, agentConn net.Conn) ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+
+	identityFiles := DefaultIdentityFiles
+	if identityFile := host.SSHConfigValue("IdentityFile"); identityFile != "" {
+		identityFiles = []string{identityFile}
+	}
+
+	for _, identityFile := range identityFiles {
+		path := expandHomeDir(identityFile)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) && identityFile != host.SSHConfigValue("IdentityFile") {
+				// the default identity file does not exist.
+				continue
+			}
+			return nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			if _, ok := err.(*ssh.PassphraseMissingError); ok {
+				// encrypted keys must be loaded by ssh-agent.
+				if debugFlag {
+					fmt.Printf("[essh debug] skip the encrypted key: %s\n", path)
+				}
+				continue
+			}
+			return nil, fmt.Errorf("failed to parse the key '%s': %v", path, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	if agentConn != nil {
+		agentSigners, err := agent.NewClient(agentConn).Signers()
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, agentSigners...)
+	}
+
+	return signers, nil
+}
+
+// dialSSHAgent connects to ssh-agent. It returns nil if the host doesn't use ssh-agent or it isn't available.
+func dialSSHAgent(host *Host) net.Conn {
+	if strings.ToLower(host.SSHConfigValue("IdentitiesOnly")) == "yes" {
+		return nil
+	}
+
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		if debugFlag {
+			fmt.Printf("[essh debug] couldn't connect to ssh-agent: %v\n", err)
+		}
+		return nil
+	}
+
+	return conn
+}
+
+func goSSHKnownHostsCallback(host *Host) (ssh.HostKeyCallback, error) {
+	files := []string{}
+	knownHostsFiles := strings.Fields(host.SSHConfigValue("UserKnownHostsFile"))
+	if len(knownHostsFiles) == 0 {
+		knownHostsFiles = []string{DefaultKnownHostsFile}
+	}
+
+	for _, f := range knownHostsFiles {
+		path := expandHomeDir(f)
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("known_hosts file is not found for the host '%s'. the built-in ssh client does not add host keys automatically.", host.Name)
+	}
+
+	return knownhosts.New(files...)
+}
+
+// knownHostKeyAlgorithms returns the key types of the host in the known_hosts,
+// so that the server offers the key that can be verified.
+func knownHostKeyAlgorithms(callback ssh.HostKeyCallback, addr string) []string {
+	err := callback(addr, &net.TCPAddr{IP: net.IPv4zero}, dummyPublicKey{})
+	keyErr, ok := err.(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+
+	algos := []string{}
+	for _, known := range keyErr.Want {
+		keyType := known.Key.Type()
+		if keyType == ssh.KeyAlgoRSA {
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algos = append(algos, keyType)
+	}
+
+	return algos
+}
+
+// dummyPublicKey is used to look up the known_hosts entries.
+type dummyPublicKey struct{}
+
+func (dummyPublicKey) Type() string                                 { return "essh-dummy" }
+func (dummyPublicKey) Marshal() []byte                              { return []byte{} }
+func (dummyPublicKey) Verify(data []byte, sig *ssh.Signature) error { return fmt.Errorf("dummy key") }
+
+func expandHomeDir(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home := os.Getenv("HOME"); home != "" {
+			return filepath.Join(home, path[1:])
+		}
+	}
+
+	return path
+}
+
+func runRemoteTaskScriptWithGoSSH(sshConfigPath string, task *Task, host *Host, hosts []*Host, stdinCh chan []byte, m *sync.Mutex) error {
+	command, input, err := remoteTaskCommand(sshConfigPath, task, host)
+	if err != nil {
+		return err
+	}
+	if input != nil {
+		stdinCh = prependStdin(input, stdinCh)
+	}
+
+	client, err := getGoSSHClient(host)
+	if err != nil {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if debugFlag {
+		fmt.Printf("[essh debug] run the command by the built-in ssh client on %s: %s \n", host.Name, redact(command))
+	}
+
+	if task.Pty {
+		width, height := 80, 40
+		if w, h, err := terminal.GetSize(int(os.Stdout.Fd())); err == nil {
+			width, height = w, h
+		}
+
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty(os.Getenv("TERM"), height, width, modes); err != nil {
+			return err
+		}
+	}
+
+	prefix, err := taskPrefix(task, host, hosts)
+	if err != nil {
+		return err
+	}
+
+	// the session waits for all the input. so stdin is always passed through the pipe.
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if stdinCh == nil {
+		go func() {
+			io.Copy(stdin, os.Stdin)
+			stdin.Close()
+		}()
+	} else {
+		go handleInput(stdinCh, stdin)
+	}
+
+	wg := &sync.WaitGroup{}
+	if len(hosts) <= 1 && prefix == "" {
+		session.Stdout = task.StdoutWriter()
+		session.Stderr = os.Stderr
+	} else {
+		stdout, err := session.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		stderr, err := session.StderrPipe()
+		if err != nil {
+			return err
+		}
+		wg.Add(2)
+		go func() {
+			scanLines(task.TeeOutput(stdout), os.Stdout, prefix, m)
+			wg.Done()
+		}()
+		go func() {
+			scanLines(stderr, os.Stderr, prefix, m)
+			wg.Done()
+		}()
+	}
+
+	if err := session.Start(command); err != nil {
+		return err
+	}
+
+	wg.Wait()
+
+	return session.Wait()
+}
@@ -0,0 +1,419 @@
+package essh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testSSHServer is an in-process ssh server that runs "exec" requests by the local sh,
+// and forwards "direct-tcpip" channels for ProxyJump.
+type testSSHServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+	dir      string
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test ssh server requires sh.")
+	}
+
+	dir, err := ioutil.TempDir("", "essh.transport_test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client key that the server accepts.
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "id_ed25519"), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	authorizedKey, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "essh" && string(key.Marshal()) == string(authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSSHServer{
+		listener: listener,
+		config:   config,
+		hostKey:  hostKey,
+		dir:      dir,
+	}
+
+	line := knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, hostKey.PublicKey())
+	if err := ioutil.WriteFile(filepath.Join(dir, "known_hosts"), []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *testSSHServer) Close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *testSSHServer) Port() string {
+	return strconv.Itoa(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// Host returns a host that connects to the server.
+func (s *testSSHServer) Host(name string) *Host {
+	host := NewHost()
+	host.Name = name
+	host.SSHConfig["HostName"] = "127.0.0.1"
+	host.SSHConfig["Port"] = s.Port()
+	host.SSHConfig["User"] = "essh"
+	host.SSHConfig["IdentityFile"] = filepath.Join(s.dir, "id_ed25519")
+	host.SSHConfig["IdentitiesOnly"] = "yes"
+	host.SSHConfig["UserKnownHostsFile"] = filepath.Join(s.dir, "known_hosts")
+	return host
+}
+
+func (s *testSSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *testSSHServer) handleConn(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			go s.handleSession(newCh)
+		case "direct-tcpip":
+			go s.handleDirectTCPIP(newCh)
+		default:
+			newCh.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (s *testSSHServer) handleSession(newCh ssh.NewChannel) {
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			req.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Stdin = ch
+			cmd.Stdout = ch
+			cmd.Stderr = ch.Stderr()
+			status := 0
+			if err := cmd.Run(); err != nil {
+				status = 255
+				if exitErr, ok := err.(*exec.ExitError); ok {
+					status = exitErr.ExitCode()
+				}
+			}
+
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, uint32(status))
+			ch.SendRequest("exit-status", false, b)
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (s *testSSHServer) handleDirectTCPIP(newCh ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newCh.ExtraData(), &payload); err != nil {
+		newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		newCh.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newCh.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(conn, ch)
+		conn.Close()
+		wg.Done()
+	}()
+	wg.Wait()
+	ch.Close()
+}
+
+func runGoSSHCommand(t *testing.T, host *Host, command string) (string, error) {
+	client, jumps, err := dialGoSSH(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeClients(jumps)
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	out, err := session.Output(command)
+	return string(out), err
+}
+
+func TestGoSSHRunCommand(t *testing.T) {
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	out, err := runGoSSHCommand(t, s.Host("web01"), "echo hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "hello\n" {
+		t.Errorf("'hello' expected, but got '%s'", out)
+	}
+}
+
+func TestGoSSHExitStatus(t *testing.T) {
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	_, err := runGoSSHCommand(t, s.Host("web01"), "exit 3")
+	exitErr, ok := err.(*ssh.ExitError)
+	if !ok {
+		t.Fatalf("*ssh.ExitError expected, but got %v", err)
+	}
+	if exitErr.ExitStatus() != 3 {
+		t.Errorf("exit status 3 expected, but got %d", exitErr.ExitStatus())
+	}
+}
+
+func TestGoSSHCaseInsensitiveSSHConfig(t *testing.T) {
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	Hosts = map[string]*Host{}
+	defer func() {
+		Hosts = map[string]*Host{}
+	}()
+	Hosts["bastion"] = s.Host("bastion")
+
+	// ssh_config keywords are case-insensitive.
+	host := NewHost()
+	host.Name = "web01"
+	for k, v := range s.Host("web01").SSHConfig {
+		host.SSHConfig[strings.ToLower(k)] = v
+	}
+	host.SSHConfig["proxyjump"] = "bastion"
+
+	out, err := runGoSSHCommand(t, host, "echo lower")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "lower\n" {
+		t.Errorf("'lower' expected, but got '%s'", out)
+	}
+}
+
+func TestGoSSHProxyJump(t *testing.T) {
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	Hosts = map[string]*Host{}
+	defer func() {
+		Hosts = map[string]*Host{}
+	}()
+	Hosts["bastion"] = s.Host("bastion")
+
+	host := s.Host("web01")
+	host.SSHConfig["ProxyJump"] = "bastion"
+
+	out, err := runGoSSHCommand(t, host, "echo through bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "through bastion\n" {
+		t.Errorf("'through bastion' expected, but got '%s'", out)
+	}
+}
+
+func TestGoSSHUnknownHostKey(t *testing.T) {
+	s := newTestSSHServer(t)
+	defer s.Close()
+
+	// replace the known host key by another key.
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.listener.Addr().String())}, otherKey)
+	if err := ioutil.WriteFile(filepath.Join(s.dir, "known_hosts"), []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := dialGoSSH(s.Host("web01")); err == nil {
+		t.Error("an error of the host key mismatch expected, but got nil")
+	}
+}
+
+func TestRunRemoteTaskScriptWithGoSSH(t *testing.T) {
+	s := newTestSSHServer(t)
+	defer s.Close()
+	defer closeGoSSHClients()
+
+	initResources()
+	defer initResources()
+
+	host := s.Host("web01")
+	hosts := []*Host{host}
+
+	task := NewTask()
+	task.Name = "example"
+	task.Script = []map[string]string{
+		map[string]string{"code": "echo $ESSH_TASK_NAME on $ESSH_HOSTNAME"},
+	}
+	task.Output = &OutputBuffer{}
+
+	if err := runRemoteTaskScriptWithGoSSH("", task, host, hosts, nil, new(sync.Mutex)); err != nil {
+		t.Fatal(err)
+	}
+
+	if out := strings.TrimSpace(task.Output.String()); out != "example on web01" {
+		t.Errorf("'example on web01' expected, but got '%s'", out)
+	}
+
+	// the second run reuses the connection.
+	if err := runRemoteTaskScriptWithGoSSH("", task, host, hosts, nil, new(sync.Mutex)); err != nil {
+		t.Fatal(err)
+	}
+	if len(goSSHClients.clients) != 1 {
+		t.Errorf("1 connection expected, but got %d", len(goSSHClients.clients))
+	}
+}
+
+func TestRunRemoteTaskScriptWithScriptTransport(t *testing.T) {
+	s := newTestSSHServer(t)
+	defer s.Close()
+	defer closeGoSSHClients()
+
+	initResources()
+	defer initResources()
+
+	host := s.Host("web01")
+	hosts := []*Host{host}
+
+	for _, scriptTransport := range []string{SCRIPT_TRANSPORT_STDIN, SCRIPT_TRANSPORT_FILE} {
+		task := NewTask()
+		task.Name = "example"
+		task.ScriptTransport = scriptTransport
+		task.Script = []map[string]string{
+			map[string]string{"code": "read line; echo \"$ESSH_TASK_NAME got $line\""},
+		}
+		task.Output = &OutputBuffer{}
+
+		// the user's input follows the script in stdin.
+		stdinCh := make(chan []byte, 1)
+		stdinCh <- []byte("hello\n")
+		close(stdinCh)
+
+		if err := runRemoteTaskScriptWithGoSSH("", task, host, hosts, stdinCh, new(sync.Mutex)); err != nil {
+			t.Fatalf("%s: %v", scriptTransport, err)
+		}
+
+		if out := strings.TrimSpace(task.Output.String()); out != "example got hello" {
+			t.Errorf("%s: 'example got hello' expected, but got '%s'", scriptTransport, out)
+		}
+	}
+}
@@ -1,9 +1,8 @@
 package essh
 
 import (
-	"fmt"
+	"encoding/json"
 	"io/ioutil"
-	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -24,6 +23,26 @@ func ShellEscape(s string) string {
 	return "'" + strings.Replace(s, "'", "'\"'\"'", -1) + "'"
 }
 
+// PythonEscape quotes the string as a python string literal.
+func PythonEscape(s string) string {
+	// a JSON string is a valid python string literal.
+	b, err := json.Marshal(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// PerlEscape quotes the string as a perl single-quoted string.
+func PerlEscape(s string) string {
+	return "'" + strings.Replace(strings.Replace(s, `\`, `\\`, -1), "'", `\'`, -1) + "'"
+}
+
+// PowerShellEscape quotes the string as a powershell single-quoted string.
+func PowerShellEscape(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
 func EnvKeyEscape(s string) string {
 	return strings.Replace(strings.Replace(s, "-", "_", -1), ".", "_", -1)
 }
@@ -36,26 +55,7 @@ func GetContentFromPath(shellPath string) ([]byte, error) {
 	var scriptContent []byte
 	if strings.HasPrefix(shellPath, "http://") || strings.HasPrefix(shellPath, "https://") {
 		// get script from remote using http.
-		if debugFlag {
-			fmt.Printf("[essh debug] get script using http from '%s'\n", shellPath)
-		}
-
-		var httpClient *http.Client = &http.Client{}
-		//if strings.HasPrefix(shellPath, "https://") {
-		//	tr := &http.Transport{
-		//		// TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		//	}
-		//	httpClient = &http.Client{Transport: tr}
-		//} else {
-		//	httpClient = &http.Client{}
-		//}
-
-		resp, err := httpClient.Get(shellPath)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-		b, err := ioutil.ReadAll(resp.Body)
+		b, err := getRemoteContent(shellPath)
 		if err != nil {
 			return nil, err
 		}